@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	Akun lokal (username dan password) untuk server yang tidak bisa
+	menghubungi Facebook, GitHub atau Google. Password disimpan sebagai
+	hash bcrypt, dan setelah login user mendapat session dan cookie yang
+	sama seperti user OAuth, jadi avatar dan room tetap bekerja. Akun
+	dengan two-factor sign in (twofactor.go) harus memasukkan kode dulu.
+*/
+
+var (
+	// ErrAccountExists is returned when registering a taken username.
+	ErrAccountExists = errors.New("chat: That username is taken.")
+	// ErrWrongPassword is returned for an unknown username or a
+	// password that does not match.
+	ErrWrongPassword = errors.New("chat: Wrong username or password.")
+)
+
+// validUsername is what local usernames may look like.
+var validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,31}$`)
+
+// minPasswordLength is the shortest password accepted.
+const minPasswordLength = 8
+
+// passwordCost is the bcrypt cost new password hashes are made with.
+var passwordCost = bcrypt.DefaultCost
+
+// account is a local user signing in with a password.
+type account struct {
+	Username string
+	UserID   string
+	Name     string
+	Email    string `json:",omitempty"`
+	Hash     []byte
+	Created  time.Time
+	// TOTPSecret is the base32 key of the authenticator app, set
+	// once two-factor sign in is on. See twofactor.go.
+	TOTPSecret string `json:",omitempty"`
+	// TOTPPending is the key being set up, until a code from it is
+	// entered.
+	TOTPPending string `json:",omitempty"`
+	// TOTPLastStep is the time step of the last code accepted, so a
+	// code cannot be used twice.
+	TOTPLastStep int64 `json:",omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes.
+	RecoveryCodes []string `json:",omitempty"`
+}
+
+// accountStore is the durable list of local accounts, keyed by
+// username.
+type accountStore struct {
+	mu       sync.RWMutex
+	path     string
+	accounts map[string]*account
+	// dummy is compared against for unknown usernames, so they take
+	// as long to refuse as wrong passwords.
+	dummy []byte
+	// failures counts the wrong second factor codes, by username.
+	failures map[string]*codeFailures
+}
+
+// loadAccounts reads the accounts stored at path. A missing file
+// gives no accounts.
+func loadAccounts(path string) (*accountStore, error) {
+	s := &accountStore{path: path, accounts: make(map[string]*account)}
+	if err := loadJSON(path, &s.accounts); err != nil {
+		return nil, err
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("not a password"), passwordCost)
+	if err != nil {
+		return nil, err
+	}
+	s.dummy = dummy
+	return s, nil
+}
+
+// Register creates an account, returning it.
+func (s *accountStore) Register(username, name, email, password string) (*account, error) {
+	username = strings.ToLower(username)
+	if !validUsername.MatchString(username) {
+		return nil, errors.New("Usernames are 3 to 32 lower case letters, digits, dots, dashes and underscores")
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("Passwords are at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = username
+	}
+
+	// local accounts get IDs of their own, an unverified email must
+	// not take over the user signing in with it elsewhere
+	m := md5.New()
+	io.WriteString(m, "local:"+username)
+	a := &account{
+		Username: username,
+		UserID:   fmt.Sprintf("%x", m.Sum(nil)),
+		Name:     name,
+		Email:    strings.ToLower(email),
+		Hash:     hash,
+		Created:  time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[username]; ok {
+		return nil, ErrAccountExists
+	}
+	s.accounts[username] = a
+	if err := saveJSON(s.path, s.accounts); err != nil {
+		delete(s.accounts, username)
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate gets the account if the password matches, or
+// ErrWrongPassword.
+func (s *accountStore) Authenticate(username, password string) (*account, error) {
+	s.mu.RLock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	hash := s.dummy
+	if ok {
+		hash = a.Hash
+	}
+	s.mu.RUnlock()
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return nil, ErrWrongPassword
+	}
+	return a, nil
+}
+
+// Account gets the account with the username.
+func (s *accountStore) Account(username string) (*account, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	return a, ok
+}
+
+// ChangePassword sets a new password once the current one is given.
+func (s *accountStore) ChangePassword(username, current, password string) error {
+	if _, err := s.Authenticate(username, current); err != nil {
+		return err
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Passwords are at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[strings.ToLower(username)]
+	old := a.Hash
+	a.Hash = hash
+	if err := saveJSON(s.path, s.accounts); err != nil {
+		a.Hash = old
+		return err
+	}
+	return nil
+}
+
+// localUser is the ChatUser of a local account.
+type localUser struct {
+	*account
+}
+
+func (u localUser) UniqueID() string {
+	return u.UserID
+}
+
+func (u localUser) Name() string {
+	return u.account.Name
+}
+
+// AvatarURL is the Gravatar of the email, since there is no provider
+// to ask for a picture.
+func (u localUser) AvatarURL() string {
+	if u.Email == "" {
+		return ""
+	}
+	m := md5.New()
+	io.WriteString(m, u.Email)
+	return fmt.Sprintf("//www.gravatar.com/avatar/%x", m.Sum(nil))
+}
+
+var (
+	// accounts keeps the local accounts.
+	accounts *accountStore
+	// allowRegister lets anybody create a local account, see
+	// authConfig.
+	allowRegister = true
+)
+
+// registerHandler creates a local account and signs it in.
+// format: POST /accounts/register username={username}&name={name}&email={email}&password={password}&confirm={password}
+func registerHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowRegister {
+		http.Error(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
+	if req.FormValue("password") != req.FormValue("confirm") {
+		http.Error(w, "The passwords do not match", http.StatusBadRequest)
+		return
+	}
+
+	a, err := accounts.Register(req.FormValue("username"), req.FormValue("name"), req.FormValue("email"), req.FormValue("password"))
+	if err == ErrAccountExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signInLocal(w, req, a)
+}
+
+// localLoginHandler signs a local account in.
+// format: POST /accounts/login username={username}&password={password}
+func localLoginHandler(w http.ResponseWriter, req *http.Request) {
+	if !localAccounts {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := accounts.Authenticate(req.FormValue("username"), req.FormValue("password"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	signInLocal(w, req, a)
+}
+
+// passwordHandler changes the password of the signed in local
+// account. Every other session of the account is ended.
+// format: POST /accounts/password current={password}&password={password}&confirm={password}
+func passwordHandler(w http.ResponseWriter, req *http.Request) {
+	if !localAccounts {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	username, ok := localUsername(userID)
+	if !ok {
+		http.Error(w, "You have no password to change", http.StatusBadRequest)
+		return
+	}
+	if req.FormValue("password") != req.FormValue("confirm") {
+		http.Error(w, "The passwords do not match", http.StatusBadRequest)
+		return
+	}
+
+	err := accounts.ChangePassword(username, req.FormValue("current"), req.FormValue("password"))
+	if err == ErrWrongPassword {
+		http.Error(w, "The current password is wrong", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// whoever knew the old password is signed out, this browser
+	// gets a new session
+	ids, err := sessions.DeleteUser(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	endSessions(ids...)
+	a, _ := accounts.Account(username)
+	completeLogin(w, req, localUser{a}, "")
+}
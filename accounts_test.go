@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useTestAccounts keeps the accounts in dir, hashing cheaply.
+func useTestAccounts(t *testing.T, dir string) {
+	passwordCost = bcrypt.MinCost
+	var err error
+	if accounts, err = loadAccounts(filepath.Join(dir, "accounts.json")); err != nil {
+		t.Fatal(err)
+	}
+	allowRegister = true
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestAccountStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestAccounts(t, dir)
+
+	a, err := accounts.Register("Mat", "", "Mat@Example.com", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Username != "mat" || a.Name != "mat" || a.UserID == "" {
+		t.Errorf("Register wrongly made %+v", a)
+	}
+	if _, err := accounts.Register("mat", "", "", "battery staple"); err != ErrAccountExists {
+		t.Errorf("a taken username should be refused, got %v", err)
+	}
+	if _, err := accounts.Register("ab", "", "", "battery staple"); err == nil {
+		t.Error("a short username should be refused")
+	}
+	if _, err := accounts.Register("tyler", "", "", "short"); err == nil {
+		t.Error("a short password should be refused")
+	}
+
+	// read back from the file
+	if accounts, err = loadAccounts(filepath.Join(dir, "accounts.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accounts.Authenticate("mat", "wrong password"); err != ErrWrongPassword {
+		t.Errorf("a wrong password should be refused, got %v", err)
+	}
+	if _, err := accounts.Authenticate("nobody", "correct horse"); err != ErrWrongPassword {
+		t.Errorf("an unknown username should be refused, got %v", err)
+	}
+	if _, err := accounts.Authenticate("MAT", "correct horse"); err != nil {
+		t.Errorf("the right password should be accepted, got %v", err)
+	}
+
+	if err := accounts.ChangePassword("mat", "wrong password", "battery staple"); err != ErrWrongPassword {
+		t.Errorf("changing the password should need the current one, got %v", err)
+	}
+	if err := accounts.ChangePassword("mat", "correct horse", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accounts.Authenticate("mat", "battery staple"); err != nil {
+		t.Errorf("the new password should be accepted, got %v", err)
+	}
+}
+
+func TestLocalLogin(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	useTestAccounts(t, dir)
+	sessions = newMemorySessions()
+
+	w := postForm(registerHandler, "/accounts/register", url.Values{
+		"username": {"mat"}, "name": {"Mat Ryer"}, "email": {"mat@example.com"},
+		"password": {"correct horse"}, "confirm": {"correct horse"},
+	})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/chat" {
+		t.Fatalf("registering should sign in, got %d: %s", w.Code, w.Body)
+	}
+
+	w = postForm(localLoginHandler, "/accounts/login", url.Values{"username": {"mat"}, "password": {"nope"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong password should be refused, got %d", w.Code)
+	}
+	w = postForm(localLoginHandler, "/accounts/login", url.Values{"username": {"mat"}, "password": {"correct horse"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("the right password should sign in, got %d: %s", w.Code, w.Body)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// the same user data an OAuth login gives
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(cookie)
+	userData, err := authUserData(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := accounts.Authenticate("mat", "correct horse")
+	if userData["userid"] != a.UserID || userData["name"] != "Mat Ryer" || userData["avatar_url"] == "" {
+		t.Errorf("signing in wrongly gave %v", userData)
+	}
+
+	other := testAuthCookie(t, map[string]interface{}{"userid": a.UserID, "name": "Mat Ryer"})
+	w = postForm(passwordHandler, "/accounts/password", url.Values{
+		"current": {"correct horse"}, "password": {"battery staple"}, "confirm": {"battery staple"},
+	}, cookie)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("changing the password failed with %d: %s", w.Code, w.Body)
+	}
+	req = httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(other)
+	if _, err := authUserData(req); err != ErrInvalidCookie {
+		t.Errorf("changing the password should end the other sessions, got %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	REST API untuk script dan integrasi yang tidak mau memakai socket.
+	Semua endpoint ada di bawah /api/v1 dan memakai JSON, dengan type yang
+	sama seperti di chat (message, roomInfo, roomSettings). User dikenali
+	dari cookie auth (sama seperti browser) atau dari API token di header
+	"Authorization: Bearer {token}", baik token dari operator maupun
+	personal token yang dibuat user sendiri (lihat tokens.go). Request
+	yang mengubah sesuatu dengan cookie harus membawa header X-CSRF-Token
+	dan body JSON, supaya tidak bisa dikirim dari form di situs lain.
+
+	Dokumentasi OpenAPI ada di /api/v1/openapi.json.
+*/
+
+// openAPIFile is the OpenAPI document describing the API.
+var openAPIFile = filepath.Join("api", "openapi.json")
+
+// apiUser is who an API token acts as.
+type apiUser struct {
+	UserID    string
+	Name      string
+	AvatarURL string
+}
+
+// apiTokenStore holds the API tokens handed out by the server
+// operator, kept in a JSON file mapping each token to its user.
+type apiTokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string]apiUser
+}
+
+// loadAPITokens reads the tokens stored at path.
+func loadAPITokens(path string) (*apiTokenStore, error) {
+	s := &apiTokenStore{path: path}
+	if err := loadJSON(path, &s.tokens); err != nil {
+		return nil, err
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]apiUser)
+	}
+	return s, nil
+}
+
+// Lookup gets the user the token belongs to.
+func (s *apiTokenStore) Lookup(token string) (apiUser, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.tokens[token]
+	return user, ok && user.UserID != ""
+}
+
+var apiTokens = &apiTokenStore{tokens: make(map[string]apiUser)}
+
+// apiUserData gets the user making an API request, from the bearer
+// token or else from the auth cookie, in the same form as the cookie
+// data.
+func apiUserData(req *http.Request) (map[string]interface{}, bool) {
+	userData, err := requestUserData(req)
+	if err != nil {
+		return nil, false
+	}
+	if userID, _ := userData["userid"].(string); userID == "" {
+		return nil, false
+	}
+	return userData, true
+}
+
+// bearerUserData gets the user of an "Authorization: Bearer {token}"
+// header value, in the same form as the cookie data.
+func bearerUserData(auth string) (map[string]interface{}, bool) {
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth {
+		return nil, false
+	}
+	return tokenUserData(token)
+}
+
+// apiCheckCSRF checks a request that changes something comes from a
+// script and not from a form on another site. Bearer tokens are never
+// sent by the browser on its own, the cookie is, so requests signed in
+// with it must carry the CSRF token in the header and a JSON body,
+// which forms cannot send.
+func apiCheckCSRF(req *http.Request) bool {
+	if requestToken(req) != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json" && req.Header.Get(csrfHeader) != "" && checkCSRF(req)
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string
+}
+
+func writeAPIError(w http.ResponseWriter, code int, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiError{Error: text})
+}
+
+// apiHandler routes the /api/v1 requests.
+//
+//	GET  /api/v1/openapi.json
+//	GET  /api/v1/rooms
+//	POST /api/v1/rooms
+//	GET  /api/v1/rooms/{room}
+//	GET  /api/v1/rooms/{room}/members
+//	GET  /api/v1/rooms/{room}/messages?limit={n}
+//	POST /api/v1/rooms/{room}/messages
+func apiHandler(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1"), "/")
+	if path == "openapi.json" {
+		http.ServeFile(w, req, openAPIFile)
+		return
+	}
+
+	userData, ok := apiUserData(req)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "Sign in or use an API token")
+		return
+	}
+	needed := scopeRead
+	if req.Method != "GET" {
+		needed = scopeWrite
+	}
+	if !hasScope(userData, needed) {
+		writeAPIError(w, http.StatusForbidden, errTokenScope.Error())
+		return
+	}
+	if req.Method != "GET" && !apiCheckCSRF(req) {
+		writeAPIError(w, http.StatusForbidden, "Requests signed in with the cookie need the "+csrfHeader+" header and a JSON body")
+		return
+	}
+
+	// route is the path with the room name taken out
+	parts := strings.Split(path, "/")
+	route := parts[0]
+	if len(parts) > 1 && parts[0] == "rooms" && parts[1] != "" {
+		route = "rooms/{room}"
+		if len(parts) > 2 {
+			route += "/" + strings.Join(parts[2:], "/")
+		}
+	}
+	if route != "rooms" && route != "rooms/{room}" && route != "rooms/{room}/members" && route != "rooms/{room}/messages" {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case route == "rooms" && req.Method == "GET":
+		apiListRooms(w, userData)
+	case route == "rooms" && req.Method == "POST":
+		apiCreateRoom(w, req, userData)
+	case route == "rooms/{room}" && req.Method == "GET":
+		apiGetRoom(w, parts[1], userData)
+	case route == "rooms/{room}/members" && req.Method == "GET":
+		apiMembers(w, parts[1], userData)
+	case route == "rooms/{room}/messages" && req.Method == "GET":
+		apiHistory(w, req, parts[1], userData)
+	case route == "rooms/{room}/messages" && req.Method == "POST":
+		apiSend(w, req, parts[1], userData)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// apiRoom gets the room config if the user can see the room.
+func apiRoom(w http.ResponseWriter, name string, userData map[string]interface{}) (roomConfig, bool) {
+	userID, _ := userData["userid"].(string)
+	cfg, ok := rooms.store.Room(name)
+	if !ok || !cfg.visibleTo(userID) {
+		writeAPIError(w, http.StatusNotFound, ErrNoRoom.Error())
+		return roomConfig{}, false
+	}
+	return cfg, true
+}
+
+func apiListRooms(w http.ResponseWriter, userData map[string]interface{}) {
+	userID, _ := userData["userid"].(string)
+	writeJSON(w, visibleRooms(userID))
+}
+
+// visibleRooms describes the rooms the user can see.
+func visibleRooms(userID string) []roomInfo {
+	list := []roomInfo{}
+	for _, cfg := range rooms.store.Rooms() {
+		if !cfg.visibleTo(userID) {
+			continue
+		}
+		if info, ok := rooms.info(cfg.Name); ok {
+			list = append(list, info)
+		}
+	}
+	return list
+}
+
+// apiNewRoom is the body of a create room request.
+type apiNewRoom struct {
+	Name       string
+	Visibility visibility
+}
+
+func apiCreateRoom(w http.ResponseWriter, req *http.Request, userData map[string]interface{}) {
+	var body apiNewRoom
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	userID, _ := userData["userid"].(string)
+	name := strings.ToLower(body.Name)
+	if code, err := createRoom(userID, name, body.Visibility); err != nil {
+		writeAPIError(w, code, err.Error())
+		return
+	}
+
+	info, _ := rooms.info(name)
+	w.Header().Set("Location", "/api/v1/rooms/"+name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func apiGetRoom(w http.ResponseWriter, name string, userData map[string]interface{}) {
+	if _, ok := apiRoom(w, name, userData); !ok {
+		return
+	}
+	info, _ := rooms.info(name)
+	writeJSON(w, info)
+}
+
+// apiMember is a member of a room and their role in it.
+type apiMember struct {
+	UserID string
+	Role   role
+}
+
+// apiMemberList is the reply to a members request.
+type apiMemberList struct {
+	Members []apiMember
+	// Online lists who is in the room right now, on any node.
+	Online []onlineUser
+}
+
+func apiMembers(w http.ResponseWriter, name string, userData map[string]interface{}) {
+	cfg, ok := apiRoom(w, name, userData)
+	if !ok {
+		return
+	}
+	resp := apiMemberList{Members: []apiMember{}, Online: []onlineUser{}}
+	for userID := range cfg.Members {
+		resp.Members = append(resp.Members, apiMember{UserID: userID, Role: roles.Role(name, userID)})
+	}
+	sort.Slice(resp.Members, func(i, j int) bool {
+		return resp.Members[i].UserID < resp.Members[j].UserID
+	})
+	if rooms.presence != nil {
+		online, err := rooms.presence.Online(name)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Online = online
+	}
+	writeJSON(w, resp)
+}
+
+// defaultHistoryPage is how many messages a history request returns
+// without a limit.
+const defaultHistoryPage = 50
+
+func apiHistory(w http.ResponseWriter, req *http.Request, name string, userData map[string]interface{}) {
+	cfg, ok := apiRoom(w, name, userData)
+	if !ok {
+		return
+	}
+	userID, _ := userData["userid"].(string)
+	if rooms.bans.IsBanned(userID) {
+		writeAPIError(w, http.StatusForbidden, errBanned.Error())
+		return
+	}
+	limit := defaultHistoryPage
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, rooms.history.recent(name, limit, cfg.Settings.RetentionDays))
+}
+
+func apiSend(w http.ResponseWriter, req *http.Request, name string, userData map[string]interface{}) {
+	var msg *message
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil || msg == nil || msg.Message == "" {
+		writeAPIError(w, http.StatusBadRequest, "The body must be a message with a Message")
+		return
+	}
+	sent, err := sendAs(userData, name, msg.Message)
+	if err == ErrNoRoom {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sent)
+}
+
+// sendAs posts a message to the room as the user, for the clients
+// that do not join the room. It returns ErrNoRoom for rooms the user
+// cannot see, or the reason the user may not post. Slash commands are
+// only understood from chat clients, here they are posted as they are.
+func sendAs(userData map[string]interface{}, name, text string) (*message, error) {
+	if !hasScope(userData, scopeWrite) {
+		return nil, errTokenScope
+	}
+	userID, _ := userData["userid"].(string)
+	cfg, ok := rooms.store.Room(name)
+	if !ok || !cfg.visibleTo(userID) {
+		return nil, ErrNoRoom
+	}
+	r, err := rooms.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkAccess(userID); err != nil {
+		return nil, err
+	}
+
+	// the same envelope a client would send
+	sent := &message{
+		Message: text,
+		When:    time.Now(),
+		UserID:  userID,
+		posted:  make(chan error, 1),
+	}
+	sent.Name, _ = userData["name"].(string)
+	sent.AvatarURL, _ = userData["avatar_url"].(string)
+
+	for {
+		select {
+		case r.forward <- sent:
+			return sent, <-sent.posted
+		case <-r.done:
+			// the room stopped for being idle, start it again
+			if r, err = rooms.get(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
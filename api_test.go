@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	apiTokens = &apiTokenStore{tokens: map[string]apiUser{
+		"secret": {UserID: "abc", Name: "Abc"},
+	}}
+
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		apiHandler(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/v1/rooms", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("requests without a cookie or token should be refused, got %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/rooms", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("requests with an unknown token should be refused, got %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/nothing", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown paths should be not found, got %d", w.Code)
+	}
+
+	w := do("POST", "/api/v1/rooms", "secret", `{"Name":"team","Visibility":"private"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a room got status %d: %s", w.Code, w.Body)
+	}
+	if cfg, _ := rooms.store.Room("team"); cfg.Owner != "abc" {
+		t.Error("the room should be owned by the token's user")
+	}
+
+	w = do("GET", "/api/v1/rooms", "secret", "")
+	var list []roomInfo
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 2 || list[0].Name != "main" || list[1].Name != "team" {
+		t.Errorf("listing rooms wrongly returned %+v", list)
+	}
+
+	w = do("POST", "/api/v1/rooms/team/messages", "secret", `{"Message":"hello"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("sending a message got status %d: %s", w.Code, w.Body)
+	}
+
+	w = do("GET", "/api/v1/rooms/team/messages?limit=10", "secret", "")
+	var history []*message
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history) != 1 || history[0].Message != "hello" || history[0].UserID != "abc" {
+		t.Errorf("the history should hold the message that was sent, got %+v", history)
+	}
+
+	w = do("GET", "/api/v1/rooms/team/members", "secret", "")
+	var members apiMemberList
+	json.NewDecoder(w.Body).Decode(&members)
+	if len(members.Members) != 1 || members.Members[0].Role != roleOwner {
+		t.Errorf("members wrongly returned %+v", members)
+	}
+
+	// with the cookie, changes need the CSRF token and a JSON body
+	sessions = newMemorySessions()
+	auth := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	withCookie := func(contentType, csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/rooms/team/messages", strings.NewReader(`{"Message":"from the page"}`))
+		req.AddCookie(auth)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		apiHandler(w, req)
+		return w
+	}
+	page := httptest.NewRequest("GET", "/chat", nil)
+	page.AddCookie(auth)
+	csrf := csrfToken(httptest.NewRecorder(), page)
+	if w := withCookie("text/plain", ""); w.Code != http.StatusForbidden {
+		t.Errorf("a form post with the cookie should be refused, got %d", w.Code)
+	}
+	if w := withCookie("text/plain", csrf); w.Code != http.StatusForbidden {
+		t.Errorf("a body that is not JSON should be refused, got %d", w.Code)
+	}
+	if w := withCookie("application/json", "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("a wrong CSRF token should be refused, got %d", w.Code)
+	}
+	if w := withCookie("application/json; charset=utf-8", csrf); w.Code != http.StatusCreated {
+		t.Errorf("a script on the page should post, got %d: %s", w.Code, w.Body)
+	}
+
+	// a private room is hidden from everybody else
+	apiTokens.tokens["other"] = apiUser{UserID: "xyz", Name: "Xyz"}
+	if w := do("POST", "/api/v1/rooms/team/messages", "other", `{"Message":"hi"}`); w.Code != http.StatusNotFound {
+		t.Errorf("non-members should not find a private room, got %d", w.Code)
+	}
+}
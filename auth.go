@@ -1,166 +1,299 @@
-package main
-
-import (
-	gomniauthcommon "github.com/stretchr/gomniauth/common"
-	"net/http"
-)
-
-type ChatUser interface {
-	UniqueID() string
-	AvatarURL() string
-}
-
-type chatUser struct {
-	gomniauthcommon.User
-	uniqueID string
-}
-
-func (u chatUser) UniqueID() string {
-	return u.uniqueID
-}
-
-type authHandler struct {
-	next http.Handler
-}
-
-func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, err := r.Cookie("auth")
-
-	if err == http.ErrNoCookie {
-		// not authenticated
-		w.Header().Set("Location", "/login")
-		w.WriteHeader(http.StatusTemporaryRedirect)
-		return
-	}
-
-	if err != nil {
-		// some other error
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// success - call the next handler
-	h.next.ServeHTTP(w, r)
-}
-
-func MustAuth(handler http.Handler) http.Handler {
-	return &authHandler{next: handler}
-}
-
-/*
-Keterangan
-
-Tipe authHandler tidak hanya mengimplement method serveHTTP (yang mana adalah extends
-dari interface http.Handler), tapi juga menyiapkan field next dengan tipe http.handler.
-
-Fungsi MustAuth sederhananya adalah instance dari Tipe authHandler yang melewatkan variabel
-next dengan tipe http.Handler, untuk memberitahukan eksekusi berikutnya setelah autetifikasi.
-
-Pola seperti ini membuat kita dengan mudah menambahkan otorisasi pada code di main program.
-*/
-
-// loginHandler handles the third-party login process.
-// format: /auth/{action}/{provider}
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	segs := strings.Split(r.URL.Path, "/")
-	action := segs[2]
-	provider := segs[3]
-
-	switch action {
-	case "login":
-
-		provider, err := gomniauth.Provider(provider)
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to get provider %s: %s", provider, err), http.StatusBadRequest)
-			return
-		}
-
-		loginUrl, err := provider.GetBeginAuthURL(nil, nil)
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to GetBeginAuthURL for %s:%s", provider, err),
-				http.StatusInternalServerError)
-			return
-		}
-
-		w.Header.Set("Location", loginUrl)
-		w.WriteHeader(http.StatusTemporaryRedirect)
-
-	case "callback":
-		provider, err := gomniauth.Provider(provider)
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to get provider %s: %s", provider, err), http.StatusBadRequest)
-			return
-		}
-
-		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to complete auth for %s: %s", provider, err), http.StatusInternalServerError)
-			return
-		}
-
-		user, err := provider.GetUser(creds)
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to get user from %s: %s", provider, err), http.StatusInternalServerError)
-			return
-		}
-
-		// authCookieValue := objx.New(map[string]interface{}{
-		// 	"name": user.Name(),
-		// }).MustBase64()
-		chatUser := &chatUser{User: user}
-		m := md5.New()
-		io.WriteString(m, strings.ToLower(user.Email()))
-		// userId := fmt.Sprintf("%x", m.Sum(nil))
-
-		chatUser.uniqueID = fmt.Sprintf("%x", m.Sum(nil))
-		avatarURL, err := avatars.GetAvatarURL(chatUser)
-		if err != nil {
-			log.Fatalln("Error when trying to GetAvatarURL", "-", err)
-		}
-
-		authCookieValue := objx.New(map[string]interface{}{
-
-			/*
-				In order to uniquely identify our users, we are going to copy Gravatar's approach by
-				hashing their e-mail address and using the resulting string as an identifier. We will
-				store the user ID in the cookie along with the rest of the user-specific data
-
-				Here, we have hashed the e-mail address and stored the resulting value in the userid
-				field at the point at which the user logs in
-			*/
-			"userid": chatUser.uniqueID,
-			"name":   user.Name(),
-			/*
-				The AvatarURL field called in the preceding code will return the appropriate
-				URL value and store it in our avatar_url field, which we then put into the
-				cookie
-			*/
-			"avatar_url": avatarURL,
-			// "email":      user.Email(),
-		}).MustBase64()
-
-		http.SetCookie(w, &http.Cookie{
-			Name:  "auth",
-			Value: authCookieValue,
-			Path:  "/"})
-		w.Header().Set("Location", "/chat")
-		w.WriteHeader(http.StatusTemporaryRedirect)
-
-		/*
-			In our case, the cookie value is eyJuYW1lIjoiTWF0IFJ5ZXIifQ==, which is a Base64- encoded
-			version of {"name":"Mat Ryer"}. Remember, we never typed in a name in our chat application;
-			instead, Gomniauth asked Google for a name when we opted to sign in with Google. Storing
-			non-signed cookies like this is fine for incidental information, such as a user's name;
-			however, you should avoid storing any sensitive information using nonsigned cookies as it's
-			easy for people to access and change the data.
-		*/
-	default:
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Auth action %s not supported", action)
-	}
-}
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/stretchr/gomniauth"
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type ChatUser interface {
+	UniqueID() string
+	Name() string
+	AvatarURL() string
+}
+
+type chatUser struct {
+	gomniauthcommon.User
+	uniqueID string
+	provider string
+}
+
+func (u chatUser) UniqueID() string {
+	return u.uniqueID
+}
+
+type authHandler struct {
+	next http.Handler
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// bots and scripts sign in with an API token instead of the cookie
+	_, err := requestUserData(r)
+
+	if err == ErrInvalidToken {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err == http.ErrNoCookie {
+		// not authenticated
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+
+	if err == ErrInvalidCookie {
+		// tampered with, or signed with a key that is gone
+		relogin(w)
+		return
+	}
+
+	if err != nil {
+		// some other error
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// success - call the next handler
+	h.next.ServeHTTP(w, r)
+}
+
+func MustAuth(handler http.Handler) http.Handler {
+	return &authHandler{next: handler}
+}
+
+// authUserData gets the user information of the session in the auth
+// cookie, returning ErrInvalidCookie if the signature does not match
+// or the session has ended.
+func authUserData(r *http.Request) (objx.Map, error) {
+	authCookie, err := r.Cookie("auth")
+	if err != nil {
+		return nil, err
+	}
+	data, err := authCookies.Decode(authCookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := data["sid"].(string)
+	userData, err := sessionUserData(id)
+	if err == ErrNoSession {
+		return nil, ErrInvalidCookie
+	}
+	if err != nil {
+		return nil, err
+	}
+	return objx.Map(userData), nil
+}
+
+/*
+Keterangan
+
+Tipe authHandler tidak hanya mengimplement method serveHTTP (yang mana adalah extends
+dari interface http.Handler), tapi juga menyiapkan field next dengan tipe http.handler.
+
+Fungsi MustAuth sederhananya adalah instance dari Tipe authHandler yang melewatkan variabel
+next dengan tipe http.Handler, untuk memberitahukan eksekusi berikutnya setelah autetifikasi.
+
+Pola seperti ini membuat kita dengan mudah menambahkan otorisasi pada code di main program.
+*/
+
+// loginHandler handles the third-party login process.
+// format: /auth/{action}/{provider}
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	action, name, ok := parseAuthPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if p, ok := oidcProviders[name]; ok {
+		if action == "login" {
+			oidcLogin(w, r, p)
+		} else {
+			oidcCallback(w, r, p)
+		}
+		return
+	}
+
+	provider, err := gomniauth.Provider(name)
+	if err != nil {
+		// not a provider that is configured
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "login":
+
+		// the state comes back with the callback, which is refused
+		// unless it matches the one kept in this browser
+		state, _, err := beginLogin(w, provider.Name(), linkTo(r))
+		if err != nil {
+			loginFailed(w, http.StatusInternalServerError, name, err)
+			return
+		}
+
+		loginUrl, err := provider.GetBeginAuthURL(gomniauth.NewState("state", state), nil)
+
+		if err != nil {
+			loginFailed(w, http.StatusBadGateway, name, fmt.Errorf("GetBeginAuthURL: %s", err))
+			return
+		}
+
+		w.Header().Set("Location", loginUrl)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+
+	case "callback":
+		var state string
+		if s, err := gomniauth.StateFromParam(r.URL.Query().Get("state")); err == nil {
+			state = s.Get("state").Str()
+		}
+		_, link, ok := finishLogin(w, r, provider.Name(), state)
+		if !ok {
+			renderError(w, http.StatusBadRequest, "Sign in failed",
+				"The sign in took too long or was started elsewhere, please try again.")
+			return
+		}
+
+		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
+
+		if err != nil {
+			loginFailed(w, http.StatusBadGateway, name, fmt.Errorf("complete auth: %s", err))
+			return
+		}
+
+		user, err := provider.GetUser(creds)
+
+		if err != nil {
+			loginFailed(w, http.StatusBadGateway, name, fmt.Errorf("get user: %s", err))
+			return
+		}
+
+		// authCookieValue := objx.New(map[string]interface{}{
+		// 	"name": user.Name(),
+		// }).MustBase64()
+		chatUser := &chatUser{User: user, provider: name}
+		m := md5.New()
+		io.WriteString(m, strings.ToLower(user.Email()))
+		// userId := fmt.Sprintf("%x", m.Sum(nil))
+
+		chatUser.uniqueID = fmt.Sprintf("%x", m.Sum(nil))
+
+		completeLogin(w, r, chatUser, link)
+	}
+}
+
+// parseAuthPath splits /auth/{action}/{provider}, reporting whether
+// the path is one loginHandler serves.
+func parseAuthPath(path string) (action, provider string, ok bool) {
+	segs := strings.Split(strings.TrimPrefix(path, "/auth/"), "/")
+	if !strings.HasPrefix(path, "/auth/") || len(segs) != 2 || segs[1] == "" {
+		return "", "", false
+	}
+	switch segs[0] {
+	case "login", "callback":
+		return segs[0], segs[1], true
+	}
+	return "", "", false
+}
+
+// loginFailed logs why signing in with the provider failed, showing
+// the user an error page without the details.
+func loginFailed(w http.ResponseWriter, status int, provider string, err error) {
+	log.Println("Error when trying to sign in with", provider, "-", err)
+	renderError(w, status, "Sign in failed",
+		fmt.Sprintf("Signing in with %s did not work, please try again later.", provider))
+}
+
+// completeLogin signs the user in once a provider, or a local
+// password, has said who they are, then takes them to the chat. With
+// link set the login is added to that user, who is already signed in.
+func completeLogin(w http.ResponseWriter, r *http.Request, login identifiedUser, link string) {
+	u, err := directory.Resolve(login, link)
+	if err == ErrIdentityLinked {
+		renderError(w, http.StatusConflict, "Already linked",
+			"That login belongs to another user, sign in with it and unlink it there first.")
+		return
+	}
+	if err != nil {
+		log.Println("Error when trying to find the user", "-", err)
+		renderError(w, http.StatusInternalServerError, "Sign in failed", "Your profile could not be loaded, please try again.")
+		return
+	}
+	if link != "" {
+		w.Header().Set("Location", "/profile")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+	user := directoryChatUser{ChatUser: login, id: u.ID}
+
+	if bans.IsBanned(user.UniqueID()) {
+		renderError(w, http.StatusForbidden, "Banned", "You have been banned from this chat.")
+		return
+	}
+	// local accounts had their second factor checked before getting here
+	if _, local := login.(localUser); !local && !checkSecondFactor(w, r, u) {
+		return
+	}
+
+	avatarURL, err := avatars.GetAvatarURL(user)
+	if err != nil {
+		// a missing picture is no reason to refuse the login
+		log.Println("Error when trying to GetAvatarURL", "-", err)
+		avatarURL, _ = UseGravatar.GetAvatarURL(user)
+	}
+
+	err = startSession(w, map[string]interface{}{
+
+		/*
+			In order to uniquely identify our users, we are going to copy Gravatar's approach by
+			hashing their e-mail address and using the resulting string as an identifier. We will
+			store the user ID in the cookie along with the rest of the user-specific data
+
+			Here, we have hashed the e-mail address and stored the resulting value in the userid
+			field at the point at which the user logs in
+
+			Sekarang userid adalah ID dari direktori user (lihat directory.go), yang
+			untuk user lama tetap md5 dari email-nya.
+		*/
+		"userid": user.UniqueID(),
+		"name":   u.Name,
+		/*
+			The AvatarURL field called in the preceding code will return the appropriate
+			URL value and store it in our avatar_url field, which we then put into the
+			cookie
+		*/
+		"avatar_url": avatarURL,
+		// "email":      user.Email(),
+	})
+	if err != nil {
+		log.Println("Error when trying to start a session", "-", err)
+		renderError(w, http.StatusInternalServerError, "Sign in failed", "Your session could not be started, please try again.")
+		return
+	}
+	w.Header().Set("Location", "/chat")
+	if r.Method == "POST" {
+		// a form was posted, the chat is fetched with GET
+		w.WriteHeader(http.StatusSeeOther)
+	} else {
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}
+
+	/*
+		In our case, the cookie value is eyJuYW1lIjoiTWF0IFJ5ZXIifQ==, which is a Base64- encoded
+		version of {"name":"Mat Ryer"}. Remember, we never typed in a name in our chat application;
+		instead, Gomniauth asked Google for a name when we opted to sign in with Google. Storing
+		non-signed cookies like this is fine for incidental information, such as a user's name;
+		however, you should avoid storing any sensitive information using nonsigned cookies as it's
+		easy for people to access and change the data.
+
+		Sekarang cookie hanya berisi session ID yang ditandatangani (lihat cookie.go
+		dan session.go), data user disimpan di server bersama session-nya.
+	*/
+}
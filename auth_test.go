@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthPath(t *testing.T) {
+
+	for path, want := range map[string]bool{
+		"/auth/login/github":       true,
+		"/auth/callback/google":    true,
+		"/auth/":                   false,
+		"/auth/login":              false,
+		"/auth/login/":             false,
+		"/auth/logout/github":      false,
+		"/auth/login/github/extra": false,
+		"/login/github":            false,
+	} {
+		if _, _, ok := parseAuthPath(path); ok != want {
+			t.Errorf("parseAuthPath(%q) ok = %v, want %v", path, ok, want)
+		}
+	}
+}
+
+func TestLoginHandlerNotFound(t *testing.T) {
+
+	for _, path := range []string{"/auth/", "/auth/login", "/auth/login/", "/auth/nope/github", "/auth/login/myspace"} {
+		w := httptest.NewRecorder()
+		loginHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s should be not found, got %d", path, w.Code)
+		}
+	}
+}
+
+// failingAvatar never has a picture.
+type failingAvatar struct{}
+
+func (failingAvatar) GetAvatarURL(ChatUser) (string, error) {
+	return "", ErrNoAvatarURL
+}
+
+func TestCompleteLoginAvatarFallback(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+	saved := avatars
+	avatars = failingAvatar{}
+	defer func() { avatars = saved }()
+
+	w := httptest.NewRecorder()
+	completeLogin(w, httptest.NewRequest("GET", "/auth/callback/mock", nil),
+		oidcUser{&oidcClaims{Issuer: "https://sso.example.com", Subject: "1234", Name: "Mat"}, "mock"}, "")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("a missing avatar should not stop the login, got %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	userData, err := authUserData(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := userData["avatar_url"].(string); !strings.Contains(url, "gravatar.com") {
+		t.Errorf("the login should fall back to Gravatar, got %q", url)
+	}
+
+	bans.Ban(ban{UserID: (oidcUser{&oidcClaims{Issuer: "https://sso.example.com", Subject: "1234"}, "mock"}).UniqueID()})
+	w = httptest.NewRecorder()
+	completeLogin(w, httptest.NewRequest("GET", "/auth/callback/mock", nil),
+		oidcUser{&oidcClaims{Issuer: "https://sso.example.com", Subject: "1234", Name: "Mat"}, "mock"}, "")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<html>") {
+		t.Errorf("a banned user should get the error page, got %d", w.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Broker passes room messages between all the server nodes, so
+// clients connected to different nodes see the same room.
+type Broker interface {
+	// Publish sends the message to every subscriber of the room, on
+	// every node, including the publishing room itself.
+	Publish(room string, msg *message) error
+	// Subscribe starts receiving the messages published to the room.
+	// Calling the returned function ends the subscription, after
+	// which the channel is closed.
+	Subscribe(room string) (<-chan *message, func(), error)
+}
+
+// memoryBroker is a Broker for running a single node, messages never
+// leave the process.
+type memoryBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[*memorySubscription]bool
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subs: make(map[string]map[*memorySubscription]bool)}
+}
+
+func (b *memoryBroker) Publish(room string, msg *message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[room] {
+		sub.push(msg)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(room string) (<-chan *message, func(), error) {
+	sub := &memorySubscription{
+		wake: make(chan struct{}, 1),
+		out:  make(chan *message),
+		quit: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.subs[room] == nil {
+		b.subs[room] = make(map[*memorySubscription]bool)
+	}
+	b.subs[room][sub] = true
+	b.mu.Unlock()
+
+	go sub.pump()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[room], sub)
+			if len(b.subs[room]) == 0 {
+				delete(b.subs, room)
+			}
+			b.mu.Unlock()
+			close(sub.quit)
+		})
+	}
+	return sub.out, stop, nil
+}
+
+// memorySubscription queues messages without limit, so a room that
+// publishes to itself from its own goroutine never blocks on its own
+// subscription.
+type memorySubscription struct {
+	mu    sync.Mutex
+	queue []*message
+	wake  chan struct{}
+	out   chan *message
+	quit  chan struct{}
+}
+
+func (s *memorySubscription) push(msg *message) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump delivers the queued messages in order until quit is closed.
+func (s *memorySubscription) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- msg:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// publish sends a message to everybody in the room, on every node.
+// Without a broker, or when publishing fails, it can only reach the
+// clients of this node. While the room is waiting to subscribe again
+// its own messages do not come back from the broker, so they are sent
+// to this node's clients straight away.
+func (r *room) publish(msg *message) {
+	if r.broker == nil {
+		r.broadcast(msg)
+		return
+	}
+	if err := r.broker.Publish(r.name, msg); err != nil {
+		r.tracer.Trace("Failed to publish message: ", err)
+		r.broadcast(msg)
+		return
+	}
+	if r.incoming == nil {
+		r.broadcast(msg)
+	}
+}
+
+// receive handles a message coming in from the broker.
+func (r *room) receive(msg *message) {
+	// settings changed on another node apply here as well, they
+	// only ever come with messages the server made
+	if msg.System && msg.Settings != nil {
+		r.settings = *msg.Settings
+	}
+	r.broadcast(msg)
+}
+
+// subscribe starts receiving the room's messages from the broker.
+func (r *room) subscribe() error {
+	incoming, unsubscribe, err := r.broker.Subscribe(r.name)
+	if err != nil {
+		return err
+	}
+	r.incoming = incoming
+	r.unsubscribe = unsubscribe
+	return nil
+}
+
+// How long a room waits before trying to subscribe again after losing
+// the broker, doubling after every failure.
+var (
+	resubscribeMinDelay = time.Second
+	resubscribeMaxDelay = time.Minute
+)
+
+// resubscribe is called when the subscription was lost, or when it is
+// time to try again. If the broker cannot be reached the room carries
+// on for this node only, telling its clients, and tries again later.
+func (r *room) resubscribe() {
+	r.unsubscribe()
+	r.retrySubscribe = nil
+	err := r.subscribe()
+	if err == nil {
+		if r.resubscribeDelay > 0 {
+			r.tracer.Trace("Subscribed to the broker again")
+			r.broadcast(newSystemMessage("Connected to the other servers again"))
+		}
+		r.resubscribeDelay = 0
+		return
+	}
+
+	r.incoming = nil
+	r.unsubscribe = func() {}
+	if r.resubscribeDelay == 0 {
+		r.tracer.Trace("Lost the broker, continuing on this node only: ", err)
+		r.broadcast(newSystemMessage("Lost the connection to the other servers, messages only reach the people on this server for now"))
+		r.resubscribeDelay = resubscribeMinDelay
+	} else {
+		r.tracer.Trace("Still cannot subscribe to the broker: ", err)
+		if r.resubscribeDelay *= 2; r.resubscribeDelay > resubscribeMaxDelay {
+			r.resubscribeDelay = resubscribeMaxDelay
+		}
+	}
+	r.retrySubscribe = time.After(r.resubscribeDelay)
+}
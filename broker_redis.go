@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"simple-go-chat/redis"
+)
+
+// redisChannelPrefix is put in front of room names to make the
+// channels rooms are published on.
+const redisChannelPrefix = "chat:room:"
+
+// redisBroker is a Broker using Redis pub/sub, or anything else
+// speaking the Redis protocol, so several nodes can share rooms.
+type redisBroker struct {
+	addr   string
+	client *redis.Client
+}
+
+// newRedisBroker makes a broker for the Redis server at addr,
+// checking that it can be reached.
+func newRedisBroker(addr string) (*redisBroker, error) {
+	b := &redisBroker{addr: addr, client: redis.NewClient(addr)}
+	if _, err := b.client.Do("PING"); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *redisBroker) Publish(room string, msg *message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Do("PUBLISH", redisChannelPrefix+room, string(data))
+	return err
+}
+
+func (b *redisBroker) Subscribe(room string) (<-chan *message, func(), error) {
+	// a subscribed connection cannot be used for anything else, so
+	// every subscription gets its own
+	conn, err := redis.Dial(b.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Do("SUBSCRIBE", redisChannelPrefix+room); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	out := make(chan *message)
+	quit := make(chan struct{})
+	go func() {
+		defer close(out)
+		for {
+			reply, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			// pushed messages look like ["message", channel, payload]
+			push, ok := reply.([]interface{})
+			if !ok || len(push) != 3 {
+				continue
+			}
+			if kind, _ := push[0].([]byte); string(kind) != "message" {
+				continue
+			}
+			payload, _ := push[2].([]byte)
+			var msg *message
+			if err := json.Unmarshal(payload, &msg); err != nil || msg == nil {
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(quit)
+			conn.Close()
+		})
+	}
+	return out, stop, nil
+}
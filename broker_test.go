@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simple-go-chat/redis"
+)
+
+// fakeRedis is a stand-in Redis server knowing just the commands the
+// broker and presence use, so they can be tested without a real one.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	down    bool
+	conns   map[net.Conn]bool
+	subs    map[string][]*fakeRedisConn
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+}
+
+type fakeRedisConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// write sends a reply, already in RESP.
+func (c *fakeRedisConn) write(reply string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write([]byte(reply))
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// newFakeRedis starts the server on a local port, it stops at the end
+// of the test.
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:      ln,
+		conns:   make(map[net.Conn]bool),
+		subs:    make(map[string][]*fakeRedisConn),
+		hashes:  make(map[string]map[string]string),
+		expires: make(map[string]time.Time),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+// drop closes every connection, as when the server restarts.
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.subs = make(map[string][]*fakeRedisConn)
+}
+
+// setDown makes the server refuse connections, or take them again.
+func (f *fakeRedis) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+	if down {
+		f.drop()
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	f.mu.Lock()
+	if f.down {
+		f.mu.Unlock()
+		conn.Close()
+		return
+	}
+	f.conns[conn] = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &fakeRedisConn{conn: conn}
+	r := redis.NewConn(conn)
+	for {
+		cmd, err := r.Receive()
+		if err != nil {
+			return
+		}
+		parts, _ := cmd.([]interface{})
+		var args []string
+		for _, part := range parts {
+			b, _ := part.([]byte)
+			args = append(args, string(b))
+		}
+		if len(args) == 0 {
+			c.write("-ERR empty command\r\n")
+			continue
+		}
+		c.write(f.do(c, strings.ToUpper(args[0]), args[1:]))
+	}
+}
+
+// do carries out a command, giving the reply.
+func (f *fakeRedis) do(c *fakeRedisConn, name string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case name == "PING":
+		return "+PONG\r\n"
+	case name == "SUBSCRIBE" && len(args) == 1:
+		f.subs[args[0]] = append(f.subs[args[0]], c)
+		return "*3\r\n" + bulk("subscribe") + bulk(args[0]) + ":1\r\n"
+	case name == "PUBLISH" && len(args) == 2:
+		for _, sub := range f.subs[args[0]] {
+			go sub.write("*3\r\n" + bulk("message") + bulk(args[0]) + bulk(args[1]))
+		}
+		return fmt.Sprintf(":%d\r\n", len(f.subs[args[0]]))
+	case name == "HSET" && len(args) == 3:
+		if f.hashes[args[0]] == nil {
+			f.hashes[args[0]] = make(map[string]string)
+		}
+		f.hashes[args[0]][args[1]] = args[2]
+		return ":1\r\n"
+	case name == "HDEL" && len(args) == 2:
+		delete(f.hashes[args[0]], args[1])
+		return ":1\r\n"
+	case name == "HGETALL" && len(args) == 1:
+		reply := fmt.Sprintf("*%d\r\n", 2*len(f.hashes[args[0]]))
+		for k, v := range f.hashes[args[0]] {
+			reply += bulk(k) + bulk(v)
+		}
+		return reply
+	case name == "SET" && len(args) == 4 && strings.ToUpper(args[2]) == "PX":
+		var ms int
+		fmt.Sscan(args[3], &ms)
+		f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case name == "EXISTS" && len(args) == 1:
+		if time.Now().Before(f.expires[args[0]]) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command " + name + "\r\n"
+}
+
+// testBroker checks that two subscribers of a room, standing in for
+// two nodes, both get every message in order.
+func testBroker(t *testing.T, broker Broker) {
+
+	first, stopFirst, err := broker.Subscribe("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopFirst()
+	second, stopSecond, err := broker.Subscribe("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, stopOther, err := broker.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopOther()
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := broker.Publish("main", &message{Name: "Mat", Message: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sub := range []<-chan *message{first, second} {
+		for _, want := range []string{"one", "two", "three"} {
+			select {
+			case msg := <-sub:
+				if msg.Message != want {
+					t.Errorf("expected %s but got %s", want, msg.Message)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %s", want)
+			}
+		}
+	}
+
+	select {
+	case msg := <-other:
+		t.Errorf("another room should not get %s", msg.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stopSecond()
+	select {
+	case _, ok := <-second:
+		if ok {
+			t.Error("the channel should be closed after unsubscribing")
+		}
+	case <-time.After(time.Second):
+		t.Error("the channel should be closed after unsubscribing")
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	testBroker(t, newMemoryBroker())
+}
+
+// TestRedisBroker runs against the Redis server given by REDIS_ADDR,
+// or else against fakeRedis.
+func TestRedisBroker(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = newFakeRedis(t).addr()
+	}
+	broker, err := newRedisBroker(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBroker(t, broker)
+}
+
+// TestResubscribe loses the broker under a running room, which keeps
+// going for its own node and subscribes again once the broker is back.
+func TestResubscribe(t *testing.T) {
+
+	defer func(min, max time.Duration) {
+		resubscribeMinDelay, resubscribeMaxDelay = min, max
+	}(resubscribeMinDelay, resubscribeMaxDelay)
+	resubscribeMinDelay, resubscribeMaxDelay = 10*time.Millisecond, 40*time.Millisecond
+
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	server := newFakeRedis(t)
+	broker, err := newRedisBroker(server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms.broker = broker
+	rooms.idleTimeout = 10 * time.Millisecond
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient("abc")
+	c.room = r
+	if _, err := r.enter(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// expect reads the messages the client gets until one holds text
+	expect := func(text string) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case msg := <-c.send:
+				if strings.Contains(msg.Message, text) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("the client never got %q", text)
+			}
+		}
+	}
+	post := func(text string) {
+		t.Helper()
+		if !c.submit(&message{Message: text}) {
+			t.Fatal("the room stopped")
+		}
+	}
+
+	server.setDown(true)
+	expect("Lost the connection")
+	post("while down")
+	expect("while down")
+
+	// a few retries fail before the broker comes back
+	time.Sleep(100 * time.Millisecond)
+	server.setDown(false)
+	expect("Connected to the other servers again")
+
+	// messages from other nodes arrive again
+	if err := broker.Publish("main", &message{Name: "Tyler", Message: "from another node"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("from another node")
+
+	r.exit(c)
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Error("the room should stop once idle")
+	}
+}
+
+// stuckBroker is a broker whose subscriptions hang until release is
+// closed, like a Redis server that does not answer.
+type stuckBroker struct {
+	*memoryBroker
+	release chan struct{}
+}
+
+func (b stuckBroker) Subscribe(room string) (<-chan *message, func(), error) {
+	<-b.release
+	return b.memoryBroker.Subscribe(room)
+}
+
+func TestStuckBroker(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	rooms.store.Create(roomConfig{Name: "other", Visibility: visibilityPublic})
+	broker := stuckBroker{newMemoryBroker(), make(chan struct{})}
+	rooms.broker = broker
+
+	done := make(chan struct{})
+	go func() {
+		rooms.get(mainRoom)
+		rooms.get("other")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a broker that does not answer should not hold up the registry")
+	}
+
+	close(broker.release)
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient("abc")
+	c.room = r
+	if _, err := r.enter(c); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish(mainRoom, &message{Name: "Tyler", Message: "from another node"})
+	select {
+	case msg := <-c.send:
+		if msg.Message != "from another node" {
+			t.Errorf("wrongly got %q", msg.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the room should subscribe once the broker answers")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens to people joining a room that is already at
+// MaxMembers, see roomSettings.Overflow.
+const (
+	// overflowReject turns them away with a "try again later" close.
+	overflowReject = "reject"
+	// overflowReadOnly lets them in to read, and they may start
+	// posting once somebody leaves.
+	overflowReadOnly = "readonly"
+)
+
+// admit decides whether a joining client gets a seat in the room. It
+// returns false if the client was turned away.
+func (r *room) admit(c *client) bool {
+	if r.hasRoomFor(c.userID()) {
+		return true
+	}
+	if r.settings.Overflow != overflowReadOnly {
+		c.closeWith(websocket.CloseTryAgainLater, "The room is full")
+		return false
+	}
+	c.readOnly = true
+	r.waiting = append(r.waiting, c)
+	c.send <- newSystemMessage("The room is full, you can read along and will be able to post once somebody leaves")
+	return true
+}
+
+// hasRoomFor reports whether the user can take part in the room. A
+// user already in the room can always open another connection.
+func (r *room) hasRoomFor(userID string) bool {
+	if r.settings.MaxMembers <= 0 {
+		return true
+	}
+	users := make(map[string]bool)
+	for client := range r.clients {
+		if client.readOnly {
+			continue
+		}
+		if client.userID() == userID {
+			return true
+		}
+		users[client.userID()] = true
+	}
+	return len(users) < r.settings.MaxMembers
+}
+
+// admitWaiting lets read-only clients take part, oldest first, for as
+// long as there is room.
+func (r *room) admitWaiting() {
+	for len(r.waiting) > 0 && r.hasRoomFor(r.waiting[0].userID()) {
+		c := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		c.readOnly = false
+		r.fanout.send(c, newSystemMessage("A seat opened up, you can now post to the room"))
+	}
+}
+
+// forgetWaiting removes a leaving client from the waiting list.
+func (r *room) forgetWaiting(c *client) {
+	for i, waiting := range r.waiting {
+		if waiting == c {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// countOccupancy updates the counts read by other goroutines through
+// roomInfoHandler.
+func (r *room) countOccupancy() {
+	users := make(map[string]bool)
+	for client := range r.clients {
+		if !client.readOnly {
+			users[client.userID()] = true
+		}
+	}
+	atomic.StoreInt64(&r.occupancy, int64(len(users)))
+	atomic.StoreInt64(&r.waitingCount, int64(len(r.waiting)))
+}
+
+// roomInfo is the public description of a room.
+type roomInfo struct {
+	Name       string
+	Visibility visibility
+	Settings   roomSettings
+	// Occupancy is the number of users taking part in the room.
+	Occupancy int
+	// Waiting is the number of read-only clients waiting for a seat.
+	Waiting int
+}
+
+// info describes the named room, including how full it is.
+func (reg *roomRegistry) info(name string) (roomInfo, bool) {
+	cfg, ok := reg.store.Room(name)
+	if !ok {
+		return roomInfo{}, false
+	}
+	info := roomInfo{Name: cfg.Name, Visibility: cfg.Visibility, Settings: cfg.Settings}
+
+	reg.mu.Lock()
+	r, running := reg.rooms[name]
+	reg.mu.Unlock()
+	if running {
+		info.Occupancy = int(atomic.LoadInt64(&r.occupancy))
+		info.Waiting = int(atomic.LoadInt64(&r.waitingCount))
+	}
+	return info, true
+}
+
+// roomInfoHandler describes a room.
+// format: GET /rooms/info?room={room}
+func roomInfoHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	name := req.FormValue("room")
+	info, ok := rooms.info(name)
+	if !ok {
+		http.Error(w, ErrNoRoom.Error(), http.StatusNotFound)
+		return
+	}
+	if cfg, _ := rooms.store.Room(name); !cfg.visibleTo(userID) {
+		http.Error(w, ErrNoRoom.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestClient(userID string) *client {
+	return &client{
+		send:     make(chan *message, messageBufferSize),
+		userData: map[string]interface{}{"userid": userID, "name": userID},
+	}
+}
+
+func TestAdmit(t *testing.T) {
+
+	r := newRoom("main", nil)
+	r.settings.MaxMembers = 1
+
+	first := newTestClient("abc")
+	if !r.admit(first) {
+		t.Fatal("the first client should get a seat")
+	}
+	r.clients[first] = true
+
+	// a second tab of the same user still fits
+	if !r.admit(newTestClient("abc")) {
+		t.Error("a user already in the room should always get in")
+	}
+
+	turnedAway := newTestClient("def")
+	if r.admit(turnedAway) {
+		t.Error("admit should turn clients away from a full room")
+	}
+	if turnedAway.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("admit wrongly closed with code %d", turnedAway.closeCode)
+	}
+
+	r.settings.Overflow = overflowReadOnly
+	reader := newTestClient("ghi")
+	if !r.admit(reader) || !reader.readOnly {
+		t.Fatal("admit should let clients read along in overflow mode")
+	}
+	r.clients[reader] = true
+
+	// once the first user leaves the waiting client can post
+	delete(r.clients, first)
+	r.admitWaiting()
+	if reader.readOnly {
+		t.Error("admitWaiting should give the free seat to the waiting client")
+	}
+}
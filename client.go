@@ -1,90 +1,166 @@
-package main
-
-import (
-	"github.com/gorilla/websocket"
-)
-
-// client represents a single chatting user.
-type client struct {
-	// socket is the web socket for this client.
-	socket *websocket.Conn
-	// send is a channel on which messages are sent.
-	send chan *message
-	// room is the room this client is chatting in.
-	room *room
-	// userData holds information about the user
-	userData map[string]interface{}
-}
-
-/*
-	The read method allows our client to read from the socket via the ReadMessage method,
-	continually sending any received messages to the forward channel on the room type
-*/
-// func (c *client) read() {
-
-// 	// fungsi defer sebaiknya digunakan untuk function
-// 	// yang tidak diketahui kapan akan diakhiri atau di
-// 	// tutup.
-// 	defer c.socket.Close()
-// 	for {
-
-// 		_, msg, err := c.socket.ReadMessage()
-// 		if err != nil {
-// 			return
-// 		}
-
-// 		c.room.forward <- msg
-// 	}
-// }
-
-/*
-	the write method continually accepts messages from the send channel writing everything
-	out of the socket via the WriteMessage method
-*/
-// func (c *client) write() {
-// 	defer c.socket.Close()
-// 	for msg := range c.send {
-// 		err := c.socket.WriteMessage(websocket.TextMessage, msg)
-// 		if err != nil {
-// 			return
-// 		}
-// 	}
-// }
-
-/*
-	komunikasi via web socket dengan JSON
-*/
-func (c *client) read() {
-	defer c.socket.Close()
-	for {
-		var msg *message
-		err := c.socket.ReadJSON(&msg)
-		if err != nil {
-			return
-		}
-		msg.When = time.Now()
-		msg.Name = c.userData["name"].(string)
-
-		// if avatarURL, ok := c.userData["avatar_url"]; ok {
-		// 	msg.AvatarURL = avatarURL.(string)
-		// }
-
-		if avatarUrl, ok := c.userData["avatar_url"]; ok {
-			msg.AvatarURL = avatarUrl.(string)
-		}
-
-		// msg.AvatarURL, _ = c.room.avatar.GetAvatarURL(c)
-
-		c.room.forward <- msg
-	}
-}
-
-func (c *client) write() {
-	defer c.socket.Close()
-	for msg := range c.send {
-		err := c.socket.WriteJSON(msg)
-		if err != nil {
-			break
-		}
-	}
-}
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// client represents a single chatting user.
+type client struct {
+	// socket is the web socket for this client.
+	socket *websocket.Conn
+	// send is a channel on which messages are sent.
+	send chan *message
+	// room is the room this client is chatting in.
+	room *room
+	// userData holds information about the user
+	userData map[string]interface{}
+	// readOnly is set by the room for clients waiting for a seat.
+	readOnly bool
+	// closeCode and closeReason are sent to the browser when the
+	// room closes the send channel, if closeCode is set.
+	closeCode   int
+	closeReason string
+	// shard is the fanout shard delivering to this client.
+	shard int
+	// format is how messages are encoded on the socket, chosen by
+	// the subprotocol.
+	format frameFormat
+	// compress is set when the client negotiated permessage-deflate.
+	compress bool
+}
+
+/*
+	The read method allows our client to read from the socket via the ReadMessage method,
+	continually sending any received messages to the forward channel on the room type
+*/
+// func (c *client) read() {
+
+// 	// fungsi defer sebaiknya digunakan untuk function
+// 	// yang tidak diketahui kapan akan diakhiri atau di
+// 	// tutup.
+// 	defer c.socket.Close()
+// 	for {
+
+// 		_, msg, err := c.socket.ReadMessage()
+// 		if err != nil {
+// 			return
+// 		}
+
+// 		c.room.forward <- msg
+// 	}
+// }
+
+/*
+	the write method continually accepts messages from the send channel writing everything
+	out of the socket via the WriteMessage method
+*/
+// func (c *client) write() {
+// 	defer c.socket.Close()
+// 	for msg := range c.send {
+// 		err := c.socket.WriteMessage(websocket.TextMessage, msg)
+// 		if err != nil {
+// 			return
+// 		}
+// 	}
+// }
+
+/*
+	komunikasi via web socket dengan JSON
+*/
+func (c *client) read() {
+	defer c.socket.Close()
+	for {
+		_, data, err := c.socket.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := decodeMessage(c.format, data)
+		if err != nil {
+			return
+		}
+		if !c.submit(msg) {
+			return
+		}
+	}
+}
+
+// submit fills in the sender details of a message the client sent
+// and hands it to the room. It returns false once the room has
+// stopped. Every transport sends messages through here.
+func (c *client) submit(msg *message) bool {
+	msg.When = time.Now()
+	msg.Name = c.userData["name"].(string)
+	msg.UserID = c.userID()
+	msg.from = c
+	// only the server makes system messages and changes settings
+	msg.System = false
+	msg.Settings = nil
+
+	// if avatarURL, ok := c.userData["avatar_url"]; ok {
+	// 	msg.AvatarURL = avatarURL.(string)
+	// }
+
+	if avatarUrl, ok := c.userData["avatar_url"]; ok {
+		msg.AvatarURL = avatarUrl.(string)
+	}
+
+	// msg.AvatarURL, _ = c.room.avatar.GetAvatarURL(c)
+
+	// slash commands go to the room instead of the other clients
+	if cmd, ok := parseCommand(c, msg.Message); ok {
+		select {
+		case c.room.commands <- cmd:
+			return true
+		case <-c.room.done:
+			return false
+		}
+	}
+
+	select {
+	case c.room.forward <- msg:
+		return true
+	case <-c.room.done:
+		// a kicked client can outlive the room
+		return false
+	}
+}
+
+func (c *client) write() {
+	defer c.socket.Close()
+	for msg := range c.send {
+		data, err := msg.frame(c.format)
+		if err != nil {
+			continue
+		}
+		if err := c.writeFrame(data); err != nil {
+			break
+		}
+	}
+	if c.closeCode != 0 {
+		c.socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(c.closeCode, c.closeReason),
+			time.Now().Add(time.Second))
+	}
+}
+
+// closeWith stops the client, telling the browser why with a close
+// code. It must only be called from the room goroutine.
+func (c *client) closeWith(code int, reason string) {
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// userID gets the unique ID of the user from the auth cookie data.
+func (c *client) userID() string {
+	userID, _ := c.userData["userid"].(string)
+	return userID
+}
+
+// name gets the display name of the user from the auth cookie data.
+func (c *client) name() string {
+	name, _ := c.userData["name"].(string)
+	return name
+}
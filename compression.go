@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+	Kompresi permessage-deflate untuk web socket. Browser menawarkan
+	extension ini saat handshake, dan upgrader menerimanya bila
+	EnableCompression di-set. Pesan yang lebih kecil dari threshold tidak
+	dikompres karena hasilnya tidak sebanding dengan CPU yang dipakai.
+*/
+
+var (
+	// compressionLevel is the flate level used for compressed clients.
+	compressionLevel = flate.BestSpeed
+	// compressionThreshold is the size in bytes from which a message
+	// is compressed.
+	compressionThreshold = 512
+)
+
+// setCompression configures permessage-deflate on the upgrader.
+func setCompression(enable bool, level, threshold int) error {
+	// the levels gorilla/websocket accepts
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("compression level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	if threshold < 0 {
+		return fmt.Errorf("compression threshold cannot be negative")
+	}
+	upgrader.EnableCompression = enable
+	compressionLevel = level
+	compressionThreshold = threshold
+	return nil
+}
+
+// offersDeflate reports whether the web socket handshake offers
+// permessage-deflate, which the upgrader accepts whenever it has
+// compression enabled.
+func offersDeflate(req *http.Request) bool {
+	for _, header := range req.Header["Sec-Websocket-Extensions"] {
+		for _, offer := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(offer, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startCompression sets up compression for a client that negotiated
+// it, which writeFrame then uses for large enough messages.
+func (c *client) startCompression(req *http.Request) {
+	c.compress = upgrader.EnableCompression && offersDeflate(req)
+	if !c.compress {
+		return
+	}
+	c.socket.SetCompressionLevel(compressionLevel)
+	c.room.tracer.Trace("Client ", c.userID(), " negotiated permessage-deflate")
+}
+
+// writeFrame writes one encoded message to the socket, compressing it
+// when the client negotiated compression and it is over the threshold.
+func (c *client) writeFrame(data []byte) error {
+	if c.compress {
+		c.socket.EnableWriteCompression(len(data) >= compressionThreshold)
+	}
+	return c.socket.WriteMessage(c.format.messageType(), data)
+}
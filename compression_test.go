@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOffersDeflate(t *testing.T) {
+
+	for header, want := range map[string]bool{
+		"":                   false,
+		"permessage-deflate": true,
+		"permessage-deflate; client_max_window_bits": true,
+		"x-webkit-deflate-frame, Permessage-Deflate": true,
+		"x-webkit-deflate-frame":                     false,
+	} {
+		req := httptest.NewRequest("GET", "/room", nil)
+		if header != "" {
+			req.Header.Set("Sec-WebSocket-Extensions", header)
+		}
+		if got := offersDeflate(req); got != want {
+			t.Errorf("offersDeflate(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestSetCompression(t *testing.T) {
+
+	defer setCompression(false, compressionLevel, compressionThreshold)
+
+	if err := setCompression(true, 10, 0); err == nil {
+		t.Error("setCompression should refuse a level above 9")
+	}
+	if err := setCompression(true, 6, -1); err == nil {
+		t.Error("setCompression should refuse a negative threshold")
+	}
+	if err := setCompression(true, 6, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if !upgrader.EnableCompression || compressionLevel != 6 || compressionThreshold != 1024 {
+		t.Error("setCompression should configure the upgrader")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/stretchr/gomniauth"
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/providers/facebook"
+	"github.com/stretchr/gomniauth/providers/github"
+	"github.com/stretchr/gomniauth/providers/google"
+)
+
+/*
+	Konfigurasi login tidak lagi ditulis langsung di main. Provider, secret,
+	base URL dan metode login dibaca dari file JSON (-auth-config), lalu
+	environment variable menimpa isi file, jadi secret tidak perlu disimpan
+	di file:
+
+		CHAT_BASE_URL, CHAT_SECURITY_KEY
+		CHAT_LOCAL_ACCOUNTS, CHAT_REGISTER       true atau false
+		CHAT_PROVIDERS                           nama provider, dipisah koma
+		CHAT_{NAME}_TYPE, CHAT_{NAME}_CLIENT_ID, CHAT_{NAME}_CLIENT_SECRET,
+		CHAT_{NAME}_ISSUER
+		CHAT_TWO_FACTOR_ROLES                    role yang wajib 2FA, dipisah koma
+
+	Konfigurasi diperiksa saat server mulai, server tidak jalan dengan
+	konfigurasi yang salah.
+*/
+
+// providerConfig is one provider users can sign in with.
+type providerConfig struct {
+	// Name is the provider in /auth/login/{name}.
+	Name string `json:"name"`
+	// Type is facebook, github, google or oidc, defaulting to the name.
+	Type string `json:"type,omitempty"`
+	// Title is shown on the login page.
+	Title        string `json:"title,omitempty"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Issuer is the issuer URL of oidc providers.
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// authConfig is how users sign in.
+type authConfig struct {
+	// BaseURL is the URL the server is reached at, the providers send
+	// users back to it.
+	BaseURL string `json:"base_url"`
+	// SecurityKey signs the state gomniauth sends along with logins.
+	SecurityKey string `json:"security_key"`
+	// LocalAccounts lets users sign in with a username and password.
+	LocalAccounts bool `json:"local_accounts"`
+	// Register lets anybody create a local account.
+	Register  bool             `json:"register"`
+	Providers []providerConfig `json:"providers"`
+	// TwoFactorRoles are the roles whose local accounts must sign in
+	// with a second factor, like "moderator" or "admin".
+	TwoFactorRoles []string `json:"two_factor_roles,omitempty"`
+}
+
+// gomniauthTypes are the provider types gomniauth knows, with their
+// titles.
+var gomniauthTypes = map[string]string{
+	"facebook": "Facebook",
+	"github":   "GitHub",
+	"google":   "Google",
+}
+
+var validProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// loadAuthConfig reads the config at path, then applies the
+// environment variables getenv gives.
+func loadAuthConfig(path string, getenv func(string) string) (*authConfig, error) {
+	cfg := &authConfig{
+		BaseURL:       "http://localhost:8081",
+		LocalAccounts: true,
+		Register:      true,
+	}
+	if path != "" {
+		if err := loadJSON(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := getenv("CHAT_BASE_URL"); v != "" {
+		cfg.BaseURL = v
+	}
+	if v := getenv("CHAT_SECURITY_KEY"); v != "" {
+		cfg.SecurityKey = v
+	}
+	for name, field := range map[string]*bool{
+		"CHAT_LOCAL_ACCOUNTS": &cfg.LocalAccounts,
+		"CHAT_REGISTER":       &cfg.Register,
+	} {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			*field = b
+		}
+	}
+	for _, name := range strings.Split(getenv("CHAT_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" && cfg.provider(name) == nil {
+			cfg.Providers = append(cfg.Providers, providerConfig{Name: name})
+		}
+	}
+	if v := getenv("CHAT_TWO_FACTOR_ROLES"); v != "" {
+		cfg.TwoFactorRoles = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.TwoFactorRoles = append(cfg.TwoFactorRoles, name)
+			}
+		}
+	}
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		prefix := "CHAT_" + strings.ToUpper(strings.Replace(p.Name, "-", "_", -1)) + "_"
+		if v := getenv(prefix + "TYPE"); v != "" {
+			p.Type = v
+		}
+		if v := getenv(prefix + "CLIENT_ID"); v != "" {
+			p.ClientID = v
+		}
+		if v := getenv(prefix + "CLIENT_SECRET"); v != "" {
+			p.ClientSecret = v
+		}
+		if v := getenv(prefix + "ISSUER"); v != "" {
+			p.Issuer = v
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *authConfig) provider(name string) *providerConfig {
+	for i := range cfg.Providers {
+		if cfg.Providers[i].Name == name {
+			return &cfg.Providers[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the config can be used, filling in defaults.
+func (cfg *authConfig) validate() error {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("base URL %q is not an http or https URL", cfg.BaseURL)
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if !cfg.LocalAccounts && len(cfg.Providers) == 0 {
+		return errors.New("no way to sign in, enable local accounts or add a provider")
+	}
+	for _, name := range cfg.TwoFactorRoles {
+		if _, err := parseRole(name); err != nil {
+			return fmt.Errorf("two-factor roles: %v", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		if !validProviderName.MatchString(p.Name) {
+			return fmt.Errorf("provider name %q is not lower case letters, digits and dashes", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("provider %s is configured twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Type == "" {
+			p.Type = p.Name
+		}
+		if p.ClientID == "" || p.ClientSecret == "" {
+			return fmt.Errorf("provider %s needs a client ID and secret", p.Name)
+		}
+
+		if title, ok := gomniauthTypes[p.Type]; ok {
+			// gomniauth knows its providers by type only
+			if p.Name != p.Type {
+				return fmt.Errorf("provider %s must be named %s", p.Name, p.Type)
+			}
+			if len(cfg.SecurityKey) < 32 {
+				return fmt.Errorf("provider %s needs a security key of at least 32 characters", p.Name)
+			}
+			if p.Title == "" {
+				p.Title = title
+			}
+			continue
+		}
+		if p.Type != "oidc" {
+			return fmt.Errorf("provider %s has unknown type %q", p.Name, p.Type)
+		}
+		issuer, err := url.Parse(p.Issuer)
+		if err != nil || (issuer.Scheme != "http" && issuer.Scheme != "https") || issuer.Host == "" {
+			return fmt.Errorf("provider %s needs an http or https issuer URL", p.Name)
+		}
+		if p.Title == "" {
+			p.Title = p.Name
+		}
+	}
+	return nil
+}
+
+// loginProvider is a provider listed on the login page.
+type loginProvider struct {
+	Name  string
+	Title string
+}
+
+var (
+	// localAccounts lets users sign in with a username and password.
+	localAccounts = true
+	// loginProviders are the providers users can sign in with.
+	loginProviders []loginProvider
+	// baseURL is the URL the server is reached at, used for the links
+	// it hands out.
+	baseURL = "http://localhost:8081"
+)
+
+// apply sets the providers up.
+func (cfg *authConfig) apply() {
+	gomniauth.SetSecurityKey(cfg.SecurityKey)
+	var providers []common.Provider
+	oidcProviders = map[string]*oidcProvider{}
+	loginProviders = nil
+	for _, p := range cfg.Providers {
+		callback := cfg.BaseURL + "/auth/callback/" + p.Name
+		switch p.Type {
+		case "facebook":
+			providers = append(providers, facebook.New(p.ClientID, p.ClientSecret, callback))
+		case "github":
+			providers = append(providers, github.New(p.ClientID, p.ClientSecret, callback))
+		case "google":
+			providers = append(providers, google.New(p.ClientID, p.ClientSecret, callback))
+		case "oidc":
+			op := newOIDCProvider(p.Name, p.Issuer, p.ClientID, p.ClientSecret)
+			op.RedirectURL = callback
+			oidcProviders[p.Name] = op
+		}
+		loginProviders = append(loginProviders, loginProvider{Name: p.Name, Title: p.Title})
+	}
+	gomniauth.WithProviders(providers...)
+	if base, err := url.Parse(cfg.BaseURL); err == nil {
+		allowedOrigins = []string{base.Scheme + "://" + base.Host}
+		if base.Host != "" {
+			twoFactorIssuer = base.Host
+		}
+	}
+	twoFactorRoles = nil
+	for _, name := range cfg.TwoFactorRoles {
+		r, _ := parseRole(name)
+		twoFactorRoles = append(twoFactorRoles, r)
+	}
+	baseURL = cfg.BaseURL
+	localAccounts = cfg.LocalAccounts
+	allowRegister = cfg.LocalAccounts && cfg.Register
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnv is a getenv over a map.
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadAuthConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"base_url": "https://chat.example.com/",
+		"local_accounts": false,
+		"providers": [
+			{"name": "corp", "type": "oidc", "title": "Corp SSO", "issuer": "https://sso.example.com", "client_id": "chat"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadAuthConfig(path, testEnv(map[string]string{
+		"CHAT_CORP_CLIENT_SECRET":   "from env",
+		"CHAT_PROVIDERS":            "github",
+		"CHAT_GITHUB_CLIENT_ID":     "id",
+		"CHAT_GITHUB_CLIENT_SECRET": "secret",
+		"CHAT_SECURITY_KEY":         strings.Repeat("k", 32),
+		"CHAT_TWO_FACTOR_ROLES":     "moderator, admin",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BaseURL != "https://chat.example.com" || cfg.LocalAccounts {
+		t.Errorf("the file was wrongly read into %+v", cfg)
+	}
+	if p := cfg.provider("corp"); p == nil || p.ClientSecret != "from env" {
+		t.Errorf("the environment should fill in the secret, got %+v", p)
+	}
+	if p := cfg.provider("github"); p == nil || p.Type != "github" || p.Title != "GitHub" {
+		t.Errorf("the environment should add providers, got %+v", p)
+	}
+
+	cfg.apply()
+	defer (&authConfig{LocalAccounts: true, Register: true}).apply()
+	if op := oidcProviders["corp"]; op == nil || op.RedirectURL != "https://chat.example.com/auth/callback/corp" {
+		t.Errorf("the oidc provider was wrongly set up as %+v", op)
+	}
+	if localAccounts || allowRegister {
+		t.Error("local accounts should be turned off")
+	}
+	if len(twoFactorRoles) != 2 || twoFactorRoles[0] != roleModerator || twoFactorIssuer != "chat.example.com" {
+		t.Errorf("two-factor sign in was wrongly set up for %v at %s", twoFactorRoles, twoFactorIssuer)
+	}
+
+	for name, env := range map[string]map[string]string{
+		"no way to sign in":   {"CHAT_LOCAL_ACCOUNTS": "false"},
+		"a bad base URL":      {"CHAT_BASE_URL": "localhost:8080"},
+		"a missing secret":    {"CHAT_PROVIDERS": "google", "CHAT_GOOGLE_CLIENT_ID": "id"},
+		"no security key":     {"CHAT_PROVIDERS": "google", "CHAT_GOOGLE_CLIENT_ID": "id", "CHAT_GOOGLE_CLIENT_SECRET": "secret"},
+		"an unknown provider": {"CHAT_PROVIDERS": "myspace", "CHAT_MYSPACE_CLIENT_ID": "id", "CHAT_MYSPACE_CLIENT_SECRET": "secret"},
+		"a bad boolean":       {"CHAT_REGISTER": "maybe"},
+		"an unknown role":     {"CHAT_TWO_FACTOR_ROLES": "boss"},
+	} {
+		if _, err := loadAuthConfig("", testEnv(env)); err == nil {
+			t.Errorf("a config with %s should be refused", name)
+		}
+	}
+}
+
+func TestLoginPageListsProviders(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+
+	cfg, err := loadAuthConfig("", testEnv(map[string]string{
+		"CHAT_LOCAL_ACCOUNTS":     "false",
+		"CHAT_PROVIDERS":          "corp",
+		"CHAT_CORP_TYPE":          "oidc",
+		"CHAT_CORP_ISSUER":        "https://sso.example.com",
+		"CHAT_CORP_CLIENT_ID":     "chat",
+		"CHAT_CORP_CLIENT_SECRET": "secret",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+	defer (&authConfig{LocalAccounts: true, Register: true}).apply()
+
+	w := httptest.NewRecorder()
+	(&templateHandler{filename: "login.html"}).ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	page := w.Body.String()
+	if !strings.Contains(page, `href="/auth/login/corp"`) {
+		t.Error("the login page should list the configured provider")
+	}
+	if strings.Contains(page, "/auth/login/google") || strings.Contains(page, "/accounts/login") {
+		t.Error("the login page should not list what is not enabled")
+	}
+}
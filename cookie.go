@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Cookie auth tidak lagi berupa base64 JSON biasa, tapi ditandatangani
+	dengan HMAC-SHA256 (dan bila diminta, dienkripsi dengan AES-GCM), jadi
+	user tidak bisa mengubah userid, name atau avatar_url di cookie.
+
+	Format cookie: {mode}.{key id}.{waktu dibuat}.{data}.{signature}, mode
+	"s" untuk data yang hanya ditandatangani dan "e" untuk data yang juga
+	dienkripsi, data dan signature dalam base64 URL tanpa padding. Key
+	dirotasi secara berkala, key yang lama masih dipakai untuk memeriksa
+	cookie sampai cookie-nya kadaluarsa.
+*/
+
+// ErrInvalidCookie is returned for auth cookies that were tampered
+// with, signed with an unknown key, or are otherwise not readable.
+var ErrInvalidCookie = errors.New("chat: Invalid auth cookie.")
+
+// authCookieMaxAge is how long an auth cookie is accepted, and so how
+// long a retired key is kept.
+const authCookieMaxAge = 30 * 24 * time.Hour
+
+// cookieKey is one of the secrets auth cookies are signed with.
+type cookieKey struct {
+	ID      string
+	Secret  []byte
+	Created time.Time
+}
+
+// derive makes a sub key of the secret for one purpose, so the same
+// secret is never used for both signing and encrypting.
+func (k *cookieKey) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	io.WriteString(mac, purpose)
+	return mac.Sum(nil)
+}
+
+// cookieCodec signs, and optionally encrypts, the auth cookie data
+// with rotating keys.
+type cookieCodec struct {
+	mu   sync.RWMutex
+	path string
+	// keys are ordered oldest first, the last one signs new cookies.
+	keys    []*cookieKey
+	encrypt bool
+	// rotateEvery is how old the signing key gets before a new one
+	// takes over, zero never rotates.
+	rotateEvery time.Duration
+}
+
+// newCookieCodec makes a codec with a fresh key that is not saved
+// anywhere, so cookies do not survive a restart.
+func newCookieCodec() *cookieCodec {
+	c := &cookieCodec{}
+	if err := c.addKey(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// loadCookieCodec reads the keys stored at path, making the first key
+// if there is none.
+func loadCookieCodec(path string, encrypt bool, rotateEvery time.Duration) (*cookieCodec, error) {
+	c := &cookieCodec{path: path, encrypt: encrypt, rotateEvery: rotateEvery}
+	if err := loadJSON(path, &c.keys); err != nil {
+		return nil, err
+	}
+	if len(c.keys) == 0 {
+		if err := c.addKey(); err != nil {
+			return nil, err
+		}
+	}
+	return c, c.Rotate()
+}
+
+// addKey makes a new signing key. The caller must hold the lock.
+func (c *cookieCodec) addKey() error {
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	c.keys = append(c.keys, &cookieKey{ID: hex.EncodeToString(id), Secret: secret, Created: time.Now()})
+	if c.path == "" {
+		return nil
+	}
+	return saveJSON(c.path, c.keys)
+}
+
+// Rotate starts signing with a new key once the current one is older
+// than rotateEvery, and forgets the keys no cookie can still be
+// signed with.
+func (c *cookieCodec) Rotate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rotateEvery <= 0 {
+		return nil
+	}
+	current := c.keys[len(c.keys)-1]
+	if time.Since(current.Created) < c.rotateEvery {
+		return nil
+	}
+
+	// a key retired when its successor was created, and signed
+	// nothing after that
+	kept := c.keys[:0]
+	for i, key := range c.keys[:len(c.keys)-1] {
+		if time.Since(c.keys[i+1].Created) < authCookieMaxAge {
+			kept = append(kept, key)
+		}
+	}
+	c.keys = append(kept, current)
+	return c.addKey()
+}
+
+// rotate keeps rotating the keys until the program ends.
+func (c *cookieCodec) rotate(every time.Duration) {
+	for range time.Tick(every) {
+		c.Rotate()
+	}
+}
+
+// Encode makes the cookie value for the user data.
+func (c *cookieCodec) Encode(data map[string]interface{}) (string, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.RLock()
+	key := c.keys[len(c.keys)-1]
+	encrypt := c.encrypt
+	c.mu.RUnlock()
+
+	mode := "s"
+	if encrypt {
+		mode = "e"
+		gcm, err := newGCM(key)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		body = gcm.Seal(nonce, nonce, body, []byte(key.ID))
+	}
+
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	value := mode + "." + key.ID + "." + issued + "." + base64.RawURLEncoding.EncodeToString(body)
+	return value + "." + base64.RawURLEncoding.EncodeToString(sign(key, value)), nil
+}
+
+// Decode checks the cookie value and gets the user data back.
+// Encrypted cookies are read even when encryption has since been
+// turned off, and the other way round.
+func (c *cookieCodec) Decode(value string) (map[string]interface{}, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 5 {
+		return nil, ErrInvalidCookie
+	}
+	mode, id, issued, payload := parts[0], parts[1], parts[2], parts[3]
+	key := c.key(id)
+	if key == nil {
+		return nil, ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || !hmac.Equal(mac, sign(key, strings.Join(parts[:4], "."))) {
+		return nil, ErrInvalidCookie
+	}
+	unix, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > authCookieMaxAge {
+		return nil, ErrInvalidCookie
+	}
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+
+	switch mode {
+	case "s":
+	case "e":
+		gcm, err := newGCM(key)
+		if err != nil || len(body) < gcm.NonceSize() {
+			return nil, ErrInvalidCookie
+		}
+		size := gcm.NonceSize()
+		if body, err = gcm.Open(nil, body[:size], body[size:], []byte(key.ID)); err != nil {
+			return nil, ErrInvalidCookie
+		}
+	default:
+		return nil, ErrInvalidCookie
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil || data == nil {
+		return nil, ErrInvalidCookie
+	}
+	return data, nil
+}
+
+// key finds the key with the id.
+func (c *cookieCodec) key(id string) *cookieKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range c.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func sign(key *cookieKey, value string) []byte {
+	mac := hmac.New(sha256.New, key.derive("sign"))
+	io.WriteString(mac, value)
+	return mac.Sum(nil)
+}
+
+func newGCM(key *cookieKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.derive("encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// authCookies signs the auth cookies.
+var authCookies = newCookieCodec()
+
+// setAuthCookie signs the user data into the auth cookie.
+func setAuthCookie(w http.ResponseWriter, data map[string]interface{}) error {
+	value, err := authCookies.Encode(data)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(authCookieMaxAge / time.Second),
+		HttpOnly: true,
+		// not sent with requests other sites make in the background
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearAuthCookie removes the auth cookie, signing the user out.
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// relogin clears a bad auth cookie and sends the user to sign in
+// again.
+func relogin(w http.ResponseWriter) {
+	clearAuthCookie(w)
+	w.Header().Set("Location", "/login")
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
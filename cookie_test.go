@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuthCookie signs the user in, returning the auth cookie of the
+// new session.
+func testAuthCookie(t *testing.T, data map[string]interface{}) *http.Cookie {
+	w := httptest.NewRecorder()
+	if err := startSession(w, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "auth" {
+			if cookie.SameSite != http.SameSiteLaxMode {
+				t.Error("the auth cookie should be SameSite=Lax")
+			}
+			return cookie
+		}
+	}
+	t.Fatal("no auth cookie was set")
+	return nil
+}
+
+func TestCookieCodec(t *testing.T) {
+
+	for _, encrypt := range []bool{false, true} {
+		c := newCookieCodec()
+		c.encrypt = encrypt
+
+		value, err := c.Encode(map[string]interface{}{"userid": "abc", "name": "Abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.Decode(value)
+		if err != nil || data["userid"] != "abc" {
+			t.Errorf("Decode should read back the data, got %v, %v", data, err)
+		}
+
+		// base64 JSON objects start with eyJ
+		parts := strings.Split(value, ".")
+		if encrypt == strings.HasPrefix(parts[3], "eyJ") {
+			t.Errorf("only unencrypted cookies should show their data, got %s", parts[3])
+		}
+
+		// change a single character of the data part
+		b := []byte(parts[3])
+		if b[0] == 'A' {
+			b[0] = 'B'
+		} else {
+			b[0] = 'A'
+		}
+		parts[3] = string(b)
+		if _, err := c.Decode(strings.Join(parts, ".")); err != ErrInvalidCookie {
+			t.Errorf("a tampered cookie should be invalid, got %v", err)
+		}
+
+		// cookies signed by another server are not accepted
+		if _, err := newCookieCodec().Decode(value); err != ErrInvalidCookie {
+			t.Errorf("a cookie signed with an unknown key should be invalid, got %v", err)
+		}
+	}
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	c, err := loadCookieCodec(path, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := c.Encode(map[string]interface{}{"userid": "abc"})
+
+	// make the signing key look old enough to be replaced
+	c.keys[0].Created = time.Now().Add(-2 * time.Hour)
+	if err := c.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.keys) != 2 {
+		t.Fatalf("Rotate should add a key, have %d", len(c.keys))
+	}
+	if _, err := c.Decode(old); err != nil {
+		t.Error("cookies signed with the previous key should still be valid")
+	}
+
+	// the keys are kept across restarts
+	again, err := loadCookieCodec(path, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := again.Decode(old); err != nil {
+		t.Error("cookies should still be valid after loading the keys again")
+	}
+
+	// once the retired key is older than any cookie it may have
+	// signed, it goes
+	c.keys[1].Created = time.Now().Add(-authCookieMaxAge - time.Hour)
+	c.Rotate()
+	if _, err := c.Decode(old); err != ErrInvalidCookie {
+		t.Error("cookies signed with a dropped key should be invalid")
+	}
+}
+
+func TestAuthHandlerRejectsTamperedCookie(t *testing.T) {
+
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: "s.0000.0.e30.AAAA"})
+	w := httptest.NewRecorder()
+	MustAuth(http.NotFoundHandler()).ServeHTTP(w, req)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/login" {
+		t.Errorf("a tampered cookie should send the user to sign in again, got %d", w.Code)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Error("a tampered cookie should be cleared")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+	Proteksi CSRF: setiap form yang mengubah sesuatu membawa token
+	"csrf", dan request dari JavaScript mengirimnya di header X-CSRF-Token.
+	Untuk user yang sudah login token-nya diturunkan dari session ID, yang
+	tidak bisa dibaca situs lain. Sebelum login (form login dan register)
+	token disimpan di cookie "csrf" dan harus sama dengan yang ada di form.
+
+	Login lewat provider juga membawa state acak yang disimpan di cookie
+	bertanda tangan, jadi callback yang tidak dimulai dari browser yang
+	sama ditolak.
+*/
+
+// csrfField is the form field, and csrfHeader the header, the token
+// is sent in.
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// randomToken makes a random hex string of n bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionCSRFToken is the token of a session. The hash does not give
+// the session ID away to whoever sees the token.
+func sessionCSRFToken(sessionID string) string {
+	sum := sha256.Sum256([]byte("csrf|" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// expectedCSRFToken is the token the request must carry, empty when
+// there is none yet.
+func expectedCSRFToken(r *http.Request) string {
+	if userData, err := authUserData(r); err == nil {
+		if id, _ := userData["session"].(string); id != "" {
+			return sessionCSRFToken(id)
+		}
+	}
+	if cookie, err := r.Cookie("csrf"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// csrfToken gets the token to put in the forms of the page, setting
+// the csrf cookie for users who are not signed in yet.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if token := expectedCSRFToken(r); token != "" {
+		return token
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "csrf",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+	})
+	return token
+}
+
+// checkCSRF reports whether the request carries the right token.
+func checkCSRF(r *http.Request) bool {
+	expected := expectedCSRFToken(r)
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.FormValue(csrfField)
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(got), []byte(expected)) == 1
+}
+
+// csrfProtect refuses requests that change something without the
+// CSRF token.
+func csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if !checkCSRF(r) {
+				http.Error(w, "The form has expired, please reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// allowedOrigins are the origins, besides the host itself, pages
+// opening web sockets may come from.
+var allowedOrigins []string
+
+// checkOrigin lets web sockets be opened from the chat's own pages
+// only, so another site cannot use the auth cookie of its visitors.
+// Clients that are not browsers send no Origin and are let in.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// beginLogin makes the state, and the nonce for OpenID Connect, of a
+// login with the provider, keeping them in a short lived signed
+// cookie until the provider sends the user back. link is the user
+// the login is to be linked to, if any.
+func beginLogin(w http.ResponseWriter, provider, link string) (state, nonce string, err error) {
+	if state, err = randomToken(16); err != nil {
+		return "", "", err
+	}
+	if nonce, err = randomToken(16); err != nil {
+		return "", "", err
+	}
+	value, err := authCookies.Encode(map[string]interface{}{
+		"provider": provider,
+		"state":    state,
+		"nonce":    nonce,
+		"link":     link,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login",
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+	return state, nonce, nil
+}
+
+// finishLogin checks the state the provider sent back is the one of
+// the login started in this browser, returning its nonce and the user
+// to link to. The login cookie is cleared either way, so it is only
+// used once.
+func finishLogin(w http.ResponseWriter, r *http.Request, provider, state string) (nonce, link string, ok bool) {
+	cookie, err := r.Cookie("login")
+	if err != nil {
+		return "", "", false
+	}
+	http.SetCookie(w, &http.Cookie{Name: "login", Path: "/auth/", MaxAge: -1})
+	login, err := authCookies.Decode(cookie.Value)
+	if err != nil || login["provider"] != provider {
+		return "", "", false
+	}
+	expected, _ := login["state"].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return "", "", false
+	}
+	nonce, _ = login["nonce"].(string)
+	link, _ = login["link"].(string)
+	return nonce, link, true
+}
+
+// linkTo gets the signed in user asking to link another login with
+// /auth/login/{provider}?link=1, empty for a normal login.
+func linkTo(r *http.Request) string {
+	if r.URL.Query().Get("link") == "" {
+		return ""
+	}
+	userData, err := authUserData(r)
+	if err != nil {
+		return ""
+	}
+	userID, _ := userData["userid"].(string)
+	return userID
+}
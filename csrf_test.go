@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+
+	sessions = newMemorySessions()
+	called := false
+	handler := csrfProtect(func(w http.ResponseWriter, r *http.Request) { called = true })
+	post := func(form url.Values, cookies ...*http.Cookie) bool {
+		called = false
+		req := httptest.NewRequest("POST", "/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		handler(httptest.NewRecorder(), req)
+		return called
+	}
+
+	// signed in, the token comes from the session
+	auth := testAuthCookie(t, map[string]interface{}{"userid": "abc"})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(auth)
+	token := csrfToken(w, req)
+	if token == "" || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("a signed in user should get the token of the session, got %q", token)
+	}
+	if post(url.Values{}, auth) {
+		t.Error("a post without the token should be refused")
+	}
+	if post(url.Values{csrfField: {"forged"}}, auth) {
+		t.Error("a post with the wrong token should be refused")
+	}
+	if !post(url.Values{csrfField: {token}}, auth) {
+		t.Error("a post with the token should be let through")
+	}
+	other := testAuthCookie(t, map[string]interface{}{"userid": "abc"})
+	if post(url.Values{csrfField: {token}}, other) {
+		t.Error("the token of one session should not work for another")
+	}
+
+	// not signed in yet, the token is kept in a cookie
+	w = httptest.NewRecorder()
+	token = csrfToken(w, httptest.NewRequest("GET", "/login", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatal("a user who is not signed in should get the token in a cookie")
+	}
+	if post(url.Values{csrfField: {token}}) {
+		t.Error("a post without the cookie should be refused")
+	}
+	if !post(url.Values{csrfField: {token}}, cookies[0]) {
+		t.Error("a post with the cookie and the token should be let through")
+	}
+
+	req = httptest.NewRequest("GET", "/logout", nil)
+	called = false
+	handler(httptest.NewRecorder(), req)
+	if !called {
+		t.Error("GET requests should not need a token")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	allowedOrigins = []string{"https://chat.example.com"}
+	defer func() { allowedOrigins = nil }()
+	for origin, want := range map[string]bool{
+		"":                         true,
+		"http://localhost:8081":    true,
+		"https://chat.example.com": true,
+		"https://evil.example.com": false,
+		"http://localhost:8082":    false,
+	} {
+		req := httptest.NewRequest("GET", "http://localhost:8081/room", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if got := checkOrigin(req); got != want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestLoginState(t *testing.T) {
+
+	w := httptest.NewRecorder()
+	state, nonce, err := beginLogin(w, "github", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+	callback := func(provider, state string) (string, string, bool) {
+		req := httptest.NewRequest("GET", "/auth/callback/"+provider, nil)
+		req.AddCookie(cookie)
+		return finishLogin(httptest.NewRecorder(), req, provider, state)
+	}
+
+	if _, _, ok := callback("github", "forged"); ok {
+		t.Error("a forged state should be refused")
+	}
+	if _, _, ok := callback("google", state); ok {
+		t.Error("the state of one provider should not work for another")
+	}
+	if got, link, ok := callback("github", state); !ok || got != nonce || link != "abc" {
+		t.Errorf("the state of the login should be accepted, got %q %q %v", got, link, ok)
+	}
+	if _, _, ok := finishLogin(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth/callback/github", nil), "github", state); ok {
+		t.Error("a callback without the login cookie should be refused")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Direktori user: setiap orang punya ID internal yang tetap, dan login
+	dari provider mana pun (identity) ditautkan ke ID tersebut. Jadi orang
+	yang sama bisa login dengan GitHub dan Google walaupun email-nya beda,
+	dan provider yang tidak memberi email tidak membuat semua user-nya
+	menjadi satu ID (md5 dari string kosong).
+
+	User baru mendapat ID yang sama seperti sebelum ada direktori (md5 dari
+	email), supaya room, role dan ban yang sudah ada tetap berlaku. Itu hanya
+	kalau provider sudah memverifikasi email-nya, selain itu ID-nya acak.
+*/
+
+var (
+	// ErrIdentityLinked is returned when linking an identity another
+	// user already has.
+	ErrIdentityLinked = errors.New("chat: That login belongs to another user.")
+	// ErrLastIdentity is returned when unlinking the only way a user
+	// can sign in.
+	ErrLastIdentity = errors.New("chat: That is the only way to sign in.")
+	// ErrNoIdentity is returned when unlinking a login the user does
+	// not have.
+	ErrNoIdentity = errors.New("chat: No such login.")
+)
+
+// noEmailID is what the user ID was for providers without an email.
+var noEmailID = fmt.Sprintf("%x", md5.Sum(nil))
+
+// identity is a login at one provider.
+type identity struct {
+	Provider string
+	Subject  string
+	// Email is what the provider said, for showing on the profile.
+	Email string `json:",omitempty"`
+	// EmailVerified is set when the provider checked the email
+	// belongs to the user. Only then does the email join the login
+	// to the user who had it before.
+	EmailVerified bool `json:",omitempty"`
+}
+
+func (i identity) key() string {
+	return i.Provider + "|" + i.Subject
+}
+
+// identifiedUser is a ChatUser that knows its login at the provider.
+type identifiedUser interface {
+	ChatUser
+	Identity() identity
+}
+
+// directoryUser is a person, however they sign in.
+type directoryUser struct {
+	ID         string
+	Name       string
+	Identities []identity
+	Created    time.Time
+}
+
+// userDirectory is the durable list of users, keyed by ID.
+type userDirectory struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*directoryUser
+	// logins finds the user of an identity key.
+	logins map[string]string
+}
+
+// loadUserDirectory reads the users stored at path. A missing file
+// gives an empty directory.
+func loadUserDirectory(path string) (*userDirectory, error) {
+	d := &userDirectory{path: path, users: make(map[string]*directoryUser), logins: make(map[string]string)}
+	if err := loadJSON(path, &d.users); err != nil {
+		return nil, err
+	}
+	for id, u := range d.users {
+		for _, ident := range u.Identities {
+			d.logins[ident.key()] = id
+		}
+	}
+	return d, nil
+}
+
+// Resolve finds the user signing in, creating them on their first
+// login. With linkTo set the identity is added to that user instead.
+func (d *userDirectory) Resolve(user identifiedUser, linkTo string) (*directoryUser, error) {
+	ident := user.Identity()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id, ok := d.logins[ident.key()]; ok {
+		if linkTo != "" && linkTo != id {
+			return nil, ErrIdentityLinked
+		}
+		u := d.users[id]
+		if name := user.Name(); name != "" && name != u.Name {
+			u.Name = name
+			if err := saveJSON(d.path, d.users); err != nil {
+				return nil, err
+			}
+		}
+		return copyUser(u), nil
+	}
+
+	var u *directoryUser
+	switch id := user.UniqueID(); {
+	case linkTo != "":
+		if u = d.users[linkTo]; u == nil {
+			return nil, ErrNoIdentity
+		}
+	case d.users[id] != nil && ident.Email != "" && ident.EmailVerified:
+		// the same email was already one user before the directory
+		u = d.users[id]
+	default:
+		// an ID made from an email the provider did not check must
+		// not go to whoever typed it in first
+		unverified := ident.Email != "" && !ident.EmailVerified
+		if id == noEmailID || unverified || d.users[id] != nil {
+			token, err := randomToken(16)
+			if err != nil {
+				return nil, err
+			}
+			id = token
+		}
+		name := user.Name()
+		if name == "" {
+			name = ident.Provider + " user"
+		}
+		u = &directoryUser{ID: id, Name: name, Created: time.Now()}
+		d.users[id] = u
+	}
+	u.Identities = append(u.Identities, ident)
+	d.logins[ident.key()] = u.ID
+	return copyUser(u), saveJSON(d.path, d.users)
+}
+
+// User gets the user with the ID.
+func (d *userDirectory) User(id string) (*directoryUser, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	u, ok := d.users[id]
+	if !ok {
+		return nil, false
+	}
+	return copyUser(u), true
+}
+
+// Unlink removes a login from the user, as long as another remains.
+func (d *userDirectory) Unlink(userID, provider, subject string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.users[userID]
+	if !ok {
+		return ErrNoIdentity
+	}
+	for i, ident := range u.Identities {
+		if ident.Provider != provider || ident.Subject != subject {
+			continue
+		}
+		if len(u.Identities) == 1 {
+			return ErrLastIdentity
+		}
+		u.Identities = append(u.Identities[:i:i], u.Identities[i+1:]...)
+		delete(d.logins, ident.key())
+		return saveJSON(d.path, d.users)
+	}
+	return ErrNoIdentity
+}
+
+func copyUser(u *directoryUser) *directoryUser {
+	c := *u
+	c.Identities = append([]identity(nil), u.Identities...)
+	return &c
+}
+
+// directory keeps the users.
+var directory *userDirectory
+
+// localUsername gets the local account of the user, if they have one.
+func localUsername(userID string) (string, bool) {
+	u, ok := directory.User(userID)
+	if !ok {
+		return "", false
+	}
+	for _, ident := range u.Identities {
+		if ident.Provider == "local" {
+			return ident.Subject, true
+		}
+	}
+	return "", false
+}
+
+// Identity of a gomniauth user is their ID at the provider, falling
+// back to the email for providers that give no ID. The email only
+// counts as verified when the provider's user data says so, as
+// Google's does.
+func (u chatUser) Identity() identity {
+	subject := u.IDForProvider(u.provider)
+	if subject == "" {
+		subject = strings.ToLower(u.Email())
+	}
+	data := u.Data()
+	return identity{
+		Provider:      u.provider,
+		Subject:       subject,
+		Email:         strings.ToLower(u.Email()),
+		EmailVerified: data.Get("verified_email").Bool() || data.Get("email_verified").Bool(),
+	}
+}
+
+func (u oidcUser) Identity() identity {
+	ident := identity{Provider: u.provider, Subject: u.Subject}
+	if u.EmailVerified {
+		ident.Email = strings.ToLower(u.Email)
+		ident.EmailVerified = true
+	}
+	return ident
+}
+
+// Identity of a local account is its username. The email was never
+// checked, so it does not join the account to anybody.
+func (u localUser) Identity() identity {
+	return identity{Provider: "local", Subject: u.Username}
+}
+
+// directoryChatUser is a ChatUser known by its directory ID, so the
+// avatars are found by that.
+type directoryChatUser struct {
+	ChatUser
+	id string
+}
+
+func (u directoryChatUser) UniqueID() string {
+	return u.id
+}
+
+// unlinkHandler removes a login from the signed in user.
+// format: POST /profile/unlink provider={provider}&subject={subject}
+func unlinkHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	err := directory.Unlink(userID, req.FormValue("provider"), req.FormValue("subject"))
+	switch err {
+	case nil:
+	case ErrLastIdentity:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case ErrNoIdentity:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/profile")
+	w.WriteHeader(http.StatusSeeOther)
+}
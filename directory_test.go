@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLogin is a login at a provider for tests.
+type testLogin struct {
+	provider, subject, email, name string
+}
+
+func (l testLogin) UniqueID() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(l.email)))
+}
+func (l testLogin) Name() string      { return l.name }
+func (l testLogin) AvatarURL() string { return "" }
+func (l testLogin) Identity() identity {
+	return identity{Provider: l.provider, Subject: l.subject, Email: l.email, EmailVerified: l.email != ""}
+}
+
+// unverifiedLogin is a login whose provider never checked the email.
+type unverifiedLogin struct {
+	testLogin
+}
+
+func (l unverifiedLogin) Identity() identity {
+	ident := l.testLogin.Identity()
+	ident.EmailVerified = false
+	return ident
+}
+
+func TestUserDirectory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	d, err := loadUserDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unchecked email does not get the ID its owner would have
+	facebook := unverifiedLogin{testLogin{"facebook", "7", "mat@example.com", "Not Mat"}}
+	early, err := d.Resolve(facebook, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if early.ID == facebook.UniqueID() {
+		t.Error("an email the provider did not check should not give the ID from the email")
+	}
+
+	github := testLogin{"github", "1", "mat@example.com", "Mat"}
+	mat, err := d.Resolve(github, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mat.ID != github.UniqueID() {
+		t.Errorf("a new user should keep the ID from the email, got %s", mat.ID)
+	}
+	if again, _ := d.Resolve(github, ""); again.ID != mat.ID {
+		t.Error("signing in again should give the same user")
+	}
+	if google, _ := d.Resolve(testLogin{"google", "9", "mat@example.com", "Mat"}, ""); google.ID != mat.ID {
+		t.Error("the same email should stay the same user, as it was before")
+	}
+	if other, _ := d.Resolve(facebook, ""); other.ID != early.ID || other.ID == mat.ID {
+		t.Error("an email the provider did not check should not sign in as the user")
+	}
+
+	// providers without an email no longer share one ID
+	first, _ := d.Resolve(testLogin{"facebook", "1", "", ""}, "")
+	second, _ := d.Resolve(testLogin{"facebook", "2", "", ""}, "")
+	if first.ID == second.ID || first.ID == noEmailID || first.Name == "" {
+		t.Errorf("users without an email were wrongly given %+v and %+v", first, second)
+	}
+
+	// an explicit link joins another email
+	work := testLogin{"oidc", "x", "mat@work.example.com", "Mat"}
+	if linked, err := d.Resolve(work, mat.ID); err != nil || linked.ID != mat.ID {
+		t.Fatalf("linking failed with %v", err)
+	}
+	if _, err := d.Resolve(work, first.ID); err != ErrIdentityLinked {
+		t.Errorf("a login linked to another user should be refused, got %v", err)
+	}
+
+	if err := d.Unlink(first.ID, "facebook", "1"); err != ErrLastIdentity {
+		t.Errorf("the last login should not be unlinked, got %v", err)
+	}
+	if err := d.Unlink(mat.ID, "google", "9"); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = loadUserDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User(mat.ID)
+	if len(u.Identities) != 2 {
+		t.Errorf("the user should be saved with two logins, got %+v", u.Identities)
+	}
+	if fresh, _ := d.Resolve(testLogin{"google", "9", "", "Mat"}, ""); fresh.ID == mat.ID {
+		t.Error("an unlinked login should no longer sign in as the user")
+	}
+}
+
+func TestUnlinkHandler(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+
+	mat, _ := directory.Resolve(testLogin{"github", "1", "mat@example.com", "Mat"}, "")
+	directory.Resolve(testLogin{"google", "9", "", "Mat"}, mat.ID)
+	cookie := testAuthCookie(t, map[string]interface{}{"userid": mat.ID})
+
+	unlink := func(provider, subject string) int {
+		form := url.Values{"provider": {provider}, "subject": {subject}}
+		req := httptest.NewRequest("POST", "/profile/unlink", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		unlinkHandler(w, req)
+		return w.Code
+	}
+	if code := unlink("google", "9"); code != http.StatusSeeOther {
+		t.Errorf("unlinking should go back to the profile, got %d", code)
+	}
+	if code := unlink("github", "1"); code != http.StatusConflict {
+		t.Errorf("unlinking the last login should conflict, got %d", code)
+	}
+	if code := unlink("github", "2"); code != http.StatusNotFound {
+		t.Errorf("unlinking a login of someone else should be not found, got %d", code)
+	}
+}
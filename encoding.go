@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"simple-go-chat/msgpack"
+)
+
+/*
+	Web socket clients memilih format pesan lewat subprotocol saat
+	handshake: "chat.json" (sama seperti sebelumnya, juga dipakai bila
+	client tidak meminta subprotocol) atau "chat.msgpack", envelope yang
+	sama tapi di-encode dengan MessagePack dalam binary frame.
+
+	Setiap message menyimpan hasil encode per format, jadi satu pesan yang
+	di-broadcast ke ribuan client hanya di-encode sekali per format.
+*/
+
+const (
+	subprotocolJSON    = "chat.json"
+	subprotocolMsgpack = "chat.msgpack"
+)
+
+// subprotocols are offered to web socket clients, in the order the
+// server prefers them.
+var subprotocols = []string{subprotocolJSON, subprotocolMsgpack}
+
+type frameFormat int
+
+const (
+	formatJSON frameFormat = iota
+	formatMsgpack
+	numFormats
+)
+
+// formatFor gets the format for the subprotocol a web socket agreed
+// on, JSON unless it was MessagePack.
+func formatFor(subprotocol string) frameFormat {
+	if subprotocol == subprotocolMsgpack {
+		return formatMsgpack
+	}
+	return formatJSON
+}
+
+// messageType is the web socket frame type the format is sent in.
+func (f frameFormat) messageType() int {
+	if f == formatMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// encodedFrame caches a message encoded in one format.
+type encodedFrame struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// frame gets the message encoded in the format, encoding it the first
+// time only.
+func (m *message) frame(f frameFormat) ([]byte, error) {
+	e := &m.frames[f]
+	e.once.Do(func() {
+		if f == formatMsgpack {
+			e.data = m.appendMsgpack(nil)
+		} else {
+			e.data, e.err = json.Marshal(m)
+		}
+	})
+	return e.data, e.err
+}
+
+// appendMsgpack encodes the message as a MessagePack map with the
+// same field names as the JSON.
+func (m *message) appendMsgpack(b []byte) []byte {
+	fields := 6
+	if m.Settings != nil {
+		fields++
+	}
+	b = msgpack.AppendMapHeader(b, fields)
+	b = msgpack.AppendString(b, "Name")
+	b = msgpack.AppendString(b, m.Name)
+	b = msgpack.AppendString(b, "Message")
+	b = msgpack.AppendString(b, m.Message)
+	b = msgpack.AppendString(b, "When")
+	b = msgpack.AppendTime(b, m.When)
+	b = msgpack.AppendString(b, "AvatarURL")
+	b = msgpack.AppendString(b, m.AvatarURL)
+	b = msgpack.AppendString(b, "UserID")
+	b = msgpack.AppendString(b, m.UserID)
+	b = msgpack.AppendString(b, "System")
+	b = msgpack.AppendBool(b, m.System)
+	if m.Settings != nil {
+		s := m.Settings
+		b = msgpack.AppendString(b, "Settings")
+		b = msgpack.AppendMapHeader(b, 7)
+		b = msgpack.AppendString(b, "Title")
+		b = msgpack.AppendString(b, s.Title)
+		b = msgpack.AppendString(b, "Topic")
+		b = msgpack.AppendString(b, s.Topic)
+		b = msgpack.AppendString(b, "Description")
+		b = msgpack.AppendString(b, s.Description)
+		b = msgpack.AppendString(b, "MaxMembers")
+		b = msgpack.AppendInt(b, int64(s.MaxMembers))
+		b = msgpack.AppendString(b, "RetentionDays")
+		b = msgpack.AppendInt(b, int64(s.RetentionDays))
+		b = msgpack.AppendString(b, "SlowMode")
+		b = msgpack.AppendInt(b, int64(s.SlowMode))
+		b = msgpack.AppendString(b, "Overflow")
+		b = msgpack.AppendString(b, s.Overflow)
+	}
+	return b
+}
+
+var errBadFrame = errors.New("the message is not a map with a Message string")
+
+// decodeMessage reads a message a client sent in the format. Only the
+// Message field is taken from MessagePack, the room fills in the rest
+// anyway.
+func decodeMessage(f frameFormat, data []byte) (*message, error) {
+	if f == formatJSON {
+		var msg *message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, errBadFrame
+		}
+		return msg, nil
+	}
+
+	v, err := msgpack.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errBadFrame
+	}
+	text, ok := fields["Message"].(string)
+	if !ok {
+		return nil, errBadFrame
+	}
+	return &message{Message: text}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"simple-go-chat/msgpack"
+)
+
+func TestMessageFrames(t *testing.T) {
+
+	msg := &message{Name: "Abc", Message: "hello", UserID: "abc", When: time.Unix(1700000000, 0)}
+
+	first, err := msg.frame(formatMsgpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := msg.frame(formatMsgpack)
+	if &first[0] != &again[0] {
+		t.Error("a message should only be encoded once per format")
+	}
+
+	v, err := msgpack.Unmarshal(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := v.(map[string]interface{})
+	if fields["Message"] != "hello" || fields["UserID"] != "abc" {
+		t.Errorf("MessagePack frame has the wrong fields: %#v", fields)
+	}
+	if when, _ := fields["When"].(time.Time); !when.Equal(msg.When) {
+		t.Errorf("MessagePack frame has the wrong time: %v", fields["When"])
+	}
+
+	decoded, err := decodeMessage(formatMsgpack, first)
+	if err != nil || decoded.Message != "hello" {
+		t.Errorf("decodeMessage should read the Message field back, got %v, %v", decoded, err)
+	}
+	if _, err := decodeMessage(formatJSON, []byte("null")); err == nil {
+		t.Error("decodeMessage should refuse an empty JSON message")
+	}
+}
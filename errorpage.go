@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// errorPage is template/error.html.
+var errorPage = &page{filename: "error.html"}
+
+// renderError shows the user an error page. Plain text is written if
+// the template cannot be used.
+func renderError(w http.ResponseWriter, status int, title, message string) {
+	err := errorPage.render(w, status, map[string]interface{}{
+		"Status":  status,
+		"Title":   title,
+		"Message": message,
+	})
+	if err != nil {
+		http.Error(w, message, status)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+)
+
+// fanoutQueueSize is how many operations a shard queues before the
+// room goroutine has to wait for it.
+const fanoutQueueSize = 256
+
+/*
+	fanout sends messages to the clients of a room from several worker
+	goroutines (shards) instead of one loop over every client. A shard never
+	waits on a client, one that is too slow to empty its buffer is closed.
+
+	Every client belongs to exactly one shard, and the shard is the only one
+	sending to or closing its send channel. A shard handles its queue in order,
+	so each client still sees the messages in the order the room sent them.
+*/
+type fanout struct {
+	shards []*shard
+	// next is the shard the next client is put in.
+	next int
+	wg   sync.WaitGroup
+}
+
+type shard struct {
+	ops     chan fanoutOp
+	clients map[*client]bool
+}
+
+type fanoutOpKind int
+
+const (
+	opAdd fanoutOpKind = iota
+	opRemove
+	opSend
+	opBroadcast
+)
+
+type fanoutOp struct {
+	kind   fanoutOpKind
+	client *client
+	msg    *message
+}
+
+// newFanout makes a fanout with n shards. The shards do not run
+// until start is called.
+func newFanout(n int) *fanout {
+	if n < 1 {
+		n = 1
+	}
+	f := &fanout{shards: make([]*shard, n)}
+	for i := range f.shards {
+		f.shards[i] = &shard{
+			ops:     make(chan fanoutOp, fanoutQueueSize),
+			clients: make(map[*client]bool),
+		}
+	}
+	return f
+}
+
+// start runs the shard goroutines.
+func (f *fanout) start() {
+	for _, s := range f.shards {
+		f.wg.Add(1)
+		go func(s *shard) {
+			defer f.wg.Done()
+			s.run()
+		}(s)
+	}
+}
+
+// stop ends the shard goroutines and waits for them to finish.
+func (f *fanout) stop() {
+	for _, s := range f.shards {
+		close(s.ops)
+	}
+	f.wg.Wait()
+}
+
+// add puts the client in the next shard, round robin.
+func (f *fanout) add(c *client) {
+	c.shard = f.next
+	f.next = (f.next + 1) % len(f.shards)
+	f.shards[c.shard].ops <- fanoutOp{kind: opAdd, client: c}
+}
+
+// remove takes the client out of its shard, which closes its send
+// channel.
+func (f *fanout) remove(c *client) {
+	f.shards[c.shard].ops <- fanoutOp{kind: opRemove, client: c}
+}
+
+// send sends the message to one client only.
+func (f *fanout) send(c *client, msg *message) {
+	f.shards[c.shard].ops <- fanoutOp{kind: opSend, client: c, msg: msg}
+}
+
+// broadcast sends the message to every client in every shard.
+func (f *fanout) broadcast(msg *message) {
+	for _, s := range f.shards {
+		s.ops <- fanoutOp{kind: opBroadcast, msg: msg}
+	}
+}
+
+func (s *shard) run() {
+	for op := range s.ops {
+		switch op.kind {
+		case opAdd:
+			s.clients[op.client] = true
+		case opRemove:
+			if s.clients[op.client] {
+				s.drop(op.client)
+			}
+		case opSend:
+			if s.clients[op.client] {
+				s.deliver(op.client, op.msg)
+			}
+		case opBroadcast:
+			for client := range s.clients {
+				s.deliver(client, op.msg)
+			}
+		}
+	}
+}
+
+// deliver hands the message to the client without ever waiting on it.
+// A client whose buffer is full cannot keep up and is closed, the room
+// forgets it once it leaves.
+func (s *shard) deliver(c *client, msg *message) {
+	select {
+	case c.send <- msg:
+	default:
+		s.drop(c)
+	}
+}
+
+// drop takes the client out of the shard and closes its send channel.
+func (s *shard) drop(c *client) {
+	delete(s.clients, c)
+	close(c.send)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drainClients makes n clients with a goroutine each standing in for
+// client.write, calling got for every message received.
+func drainClients(n int, got func(c *client, msg *message)) ([]*client, *sync.WaitGroup) {
+	var wg sync.WaitGroup
+	clients := make([]*client, n)
+	for i := range clients {
+		c := newTestClient(fmt.Sprint("user", i))
+		clients[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range c.send {
+				json.Marshal(msg)
+				got(c, msg)
+			}
+		}()
+	}
+	return clients, &wg
+}
+
+func TestFanoutKeepsOrder(t *testing.T) {
+
+	var mu sync.Mutex
+	received := make(map[*client][]string)
+	clients, wg := drainClients(50, func(c *client, msg *message) {
+		mu.Lock()
+		received[c] = append(received[c], msg.Message)
+		mu.Unlock()
+	})
+
+	f := newFanout(4)
+	f.start()
+	for _, c := range clients {
+		f.add(c)
+	}
+	for i := 0; i < 100; i++ {
+		f.broadcast(&message{Message: fmt.Sprint(i)})
+	}
+	f.send(clients[0], &message{Message: "just you"})
+	for _, c := range clients {
+		f.remove(c)
+	}
+	f.stop()
+	wg.Wait()
+
+	for _, c := range clients {
+		msgs := received[c]
+		want := 100
+		if c == clients[0] {
+			want = 101
+		}
+		if len(msgs) != want {
+			t.Fatalf("expected %d messages but got %d", want, len(msgs))
+		}
+		for i := 0; i < 100; i++ {
+			if msgs[i] != fmt.Sprint(i) {
+				t.Fatalf("message %d arrived out of order: %s", i, msgs[i])
+			}
+		}
+	}
+	if received[clients[0]][100] != "just you" {
+		t.Error("send should only reach the one client, after the broadcasts")
+	}
+}
+
+// serialBroadcast is how rooms used to send messages, one loop over
+// every client in the room goroutine.
+func serialBroadcast(clients map[*client]bool, msg *message) {
+	for client := range clients {
+		client.send <- msg
+	}
+}
+
+const benchmarkClientCount = 2000
+
+func BenchmarkSerialBroadcast(b *testing.B) {
+	clients, wg := drainClients(benchmarkClientCount, func(*client, *message) {})
+	set := make(map[*client]bool)
+	for _, c := range clients {
+		set[c] = true
+	}
+	msg := &message{Name: "Mat", Message: "Hello everybody"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serialBroadcast(set, msg)
+	}
+	for _, c := range clients {
+		close(c.send)
+	}
+	wg.Wait()
+}
+
+func BenchmarkFanoutBroadcast(b *testing.B) {
+	clients, wg := drainClients(benchmarkClientCount, func(*client, *message) {})
+	f := newFanout(8)
+	f.start()
+	for _, c := range clients {
+		f.add(c)
+	}
+	msg := &message{Name: "Mat", Message: "Hello everybody"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.broadcast(msg)
+	}
+	for _, c := range clients {
+		f.remove(c)
+	}
+	f.stop()
+	wg.Wait()
+}
+
+func TestFanoutClosesSlowClient(t *testing.T) {
+
+	n := messageBufferSize + fanoutQueueSize + 10
+	fast, slow := newTestClient("fast"), newTestClient("slow")
+	fast.send = make(chan *message, n)
+
+	// one shard, so the slow client would hold up the other one
+	f := newFanout(1)
+	f.start()
+	f.add(fast)
+	f.add(slow)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			f.broadcast(&message{Message: fmt.Sprint(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a client that does not read should not hold up the room")
+	}
+	f.remove(fast)
+	f.remove(slow)
+	f.stop()
+
+	if len(fast.send) != n {
+		t.Errorf("the other client should get every message, got %d of %d", len(fast.send), n)
+	}
+	count := 0
+	for range slow.send {
+		count++
+	}
+	if count != messageBufferSize {
+		t.Errorf("the slow client should be closed once its buffer is full, it got %d messages", count)
+	}
+}
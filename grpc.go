@@ -0,0 +1,166 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chatpb/chat.proto
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"simple-go-chat/chatpb"
+)
+
+/*
+	gRPC server untuk backend services, berjalan di samping HTTP server.
+	Service-nya (chatpb/chat.proto) memakai room yang sama dengan browser:
+	Send dan ListRooms sama seperti REST API, sedangkan Subscribe join ke
+	room sebagai client biasa dan mengirim setiap pesan lewat stream.
+
+	User dikenali dari API token di metadata "authorization: Bearer {token}".
+*/
+
+// chatServer implements chatpb.ChatServer on top of the rooms.
+type chatServer struct {
+	chatpb.UnimplementedChatServer
+}
+
+// serveGRPC runs the gRPC server on addr until it fails.
+func serveGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	chatpb.RegisterChatServer(s, &chatServer{})
+	return s.Serve(lis)
+}
+
+// grpcUserData gets the user calling, from the API token in the
+// metadata, if the token allows the scope.
+func grpcUserData(ctx context.Context, needed scope) (map[string]interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if userData, ok := bearerUserData(auth); ok {
+			if !hasScope(userData, needed) {
+				return nil, status.Error(codes.PermissionDenied, errTokenScope.Error())
+			}
+			return userData, nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "Use an API token")
+}
+
+func (s *chatServer) Send(ctx context.Context, req *chatpb.SendRequest) (*chatpb.Message, error) {
+	userData, err := grpcUserData(ctx, scopeWrite)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetMessage() == "" {
+		return nil, status.Error(codes.InvalidArgument, "The message is empty")
+	}
+	sent, err := sendAs(userData, req.GetRoom(), req.GetMessage())
+	if err == ErrNoRoom {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return messageProto(sent), nil
+}
+
+func (s *chatServer) Subscribe(req *chatpb.SubscribeRequest, stream chatpb.Chat_SubscribeServer) error {
+	userData, err := grpcUserData(stream.Context(), scopeRead)
+	if err != nil {
+		return err
+	}
+	userID, _ := userData["userid"].(string)
+	cfg, ok := rooms.store.Room(req.GetRoom())
+	if !ok || !cfg.visibleTo(userID) {
+		return status.Error(codes.NotFound, ErrNoRoom.Error())
+	}
+	r, err := rooms.get(req.GetRoom())
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err := r.checkAccess(userID); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	// a client like any other, only without a socket
+	c := &client{
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: userData,
+	}
+	if _, err := r.enter(c); err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	defer func() { c.room.exit(c) }()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				// kicked, or turned away from a full room
+				return status.Error(codes.Aborted, c.closeReason)
+			}
+			if err := stream.Send(messageProto(msg)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *chatServer) ListRooms(ctx context.Context, req *chatpb.ListRoomsRequest) (*chatpb.ListRoomsResponse, error) {
+	userData, err := grpcUserData(ctx, scopeRead)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := userData["userid"].(string)
+	resp := &chatpb.ListRoomsResponse{}
+	for _, info := range visibleRooms(userID) {
+		resp.Rooms = append(resp.Rooms, &chatpb.Room{
+			Name:       info.Name,
+			Visibility: string(info.Visibility),
+			Settings:   settingsProto(&info.Settings),
+			Occupancy:  int32(info.Occupancy),
+			Waiting:    int32(info.Waiting),
+		})
+	}
+	return resp, nil
+}
+
+// messageProto converts a message for gRPC.
+func messageProto(msg *message) *chatpb.Message {
+	m := &chatpb.Message{
+		Name:      msg.Name,
+		Message:   msg.Message,
+		When:      timestamppb.New(msg.When),
+		AvatarUrl: msg.AvatarURL,
+		UserId:    msg.UserID,
+		System:    msg.System,
+	}
+	if msg.Settings != nil {
+		m.Settings = settingsProto(msg.Settings)
+	}
+	return m
+}
+
+func settingsProto(s *roomSettings) *chatpb.RoomSettings {
+	return &chatpb.RoomSettings{
+		Title:         s.Title,
+		Topic:         s.Topic,
+		Description:   s.Description,
+		MaxMembers:    int32(s.MaxMembers),
+		RetentionDays: int32(s.RetentionDays),
+		SlowMode:      int32(s.SlowMode),
+		Overflow:      s.Overflow,
+	}
+}
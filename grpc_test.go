@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"simple-go-chat/chatpb"
+)
+
+func TestGRPC(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	apiTokens = &apiTokenStore{tokens: map[string]apiUser{
+		"secret": {UserID: "abc", Name: "Abc"},
+	}}
+
+	lis := bufconn.Listen(1 << 16)
+	s := grpc.NewServer()
+	chatpb.RegisterChatServer(s, &chatServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	chat := chatpb.NewChatClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := chat.ListRooms(ctx, &chatpb.ListRoomsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("calls without a token should be refused, got %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	list, err := chat.ListRooms(ctx, &chatpb.ListRoomsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Rooms) != 1 || list.Rooms[0].Name != mainRoom {
+		t.Errorf("ListRooms wrongly returned %v", list.Rooms)
+	}
+
+	stream, err := chat.Subscribe(ctx, &chatpb.SubscribeRequest{Room: mainRoom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait until the subscriber has joined, so it sees the message
+	r, _ := rooms.get(mainRoom)
+	for i := 0; i < 100 && atomic.LoadInt64(&r.occupancy) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a browser in the same room
+	browser := newTestClient("xyz")
+	browser.room = r
+	if _, err := r.enter(browser); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chat.Send(ctx, &chatpb.SendRequest{Room: mainRoom, Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Message != "hello" || got.UserId != "abc" {
+		t.Errorf("Subscribe wrongly streamed %v", got)
+	}
+	select {
+	case msg := <-browser.send:
+		if msg.Message != "hello" {
+			t.Errorf("the browser got %q", msg.Message)
+		}
+	case <-time.After(time.Second):
+		t.Error("a message sent over gRPC should reach the browsers in the room")
+	}
+
+	if _, err := chat.Send(ctx, &chatpb.SendRequest{Room: "nope", Message: "hi"}); status.Code(err) != codes.NotFound {
+		t.Errorf("sending to an unknown room should be not found, got %v", err)
+	}
+}
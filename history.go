@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultHistoryLimit is how many messages are kept per room unless
+// configured otherwise.
+const defaultHistoryLimit = 500
+
+// messageHistory keeps the latest messages of every room in memory,
+// so they outlive rooms stopping for being idle. Messages older than
+// a room's RetentionDays are dropped.
+type messageHistory struct {
+	mu    sync.Mutex
+	limit int
+	rooms map[string][]*message
+}
+
+func newMessageHistory(limit int) *messageHistory {
+	return &messageHistory{limit: limit, rooms: make(map[string][]*message)}
+}
+
+// add remembers a message sent in the room.
+func (h *messageHistory) add(room string, msg *message, retentionDays int) {
+	if h.limit <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := expire(append(h.rooms[room], msg), retentionDays)
+	if len(list) > h.limit {
+		// copy so the dropped messages can be collected
+		list = append([]*message(nil), list[len(list)-h.limit:]...)
+	}
+	h.rooms[room] = list
+}
+
+// recent gets up to n of the latest messages in the room, oldest
+// first.
+func (h *messageHistory) recent(room string, n, retentionDays int) []*message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := expire(h.rooms[room], retentionDays)
+	h.rooms[room] = list
+	if n > 0 && len(list) > n {
+		list = list[len(list)-n:]
+	}
+	return append([]*message{}, list...)
+}
+
+// expire drops the messages older than the retention period from the
+// front of the list, zero days keeps them all.
+func expire(list []*message, retentionDays int) []*message {
+	if retentionDays <= 0 {
+		return list
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	i := 0
+	for i < len(list) && list[i].When.Before(cutoff) {
+		i++
+	}
+	return list[i:]
+}
+
+// remember adds a message sent to everybody in the room to the
+// history.
+func (r *room) remember(msg *message) {
+	if r.history != nil {
+		r.history.add(r.name, msg, r.settings.RetentionDays)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+)
+
+// resetIdle starts the idle timer when the last client has left and
+// stops it again when somebody joins. It returns the channel the room
+// should wait on, which is nil while the room is in use.
+func (r *room) resetIdle() <-chan time.Time {
+	switch {
+	case len(r.clients) > 0 && r.idle != nil:
+		r.idle.Stop()
+		r.idle = nil
+	case len(r.clients) == 0 && r.idle == nil && r.idleTimeout > 0:
+		r.idle = time.NewTimer(r.idleTimeout)
+	}
+	if r.idle == nil {
+		return nil
+	}
+	return r.idle.C
+}
+
+// release removes an idle room from the registry and closes its done
+// channel. It returns false if the room should keep running.
+func (reg *roomRegistry) release(r *room) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.rooms[r.name] != r {
+		return false
+	}
+	delete(reg.rooms, r.name)
+	reg.keepState(r)
+	close(r.done)
+	return true
+}
+
+// roomState is what a room only keeps in memory, held by the registry
+// while the room is stopped so mutes and slow mode carry on once it
+// runs again.
+type roomState struct {
+	muted      map[string]time.Time
+	lastPosted map[string]time.Time
+}
+
+// keepState saves the mutes and slow mode times of the stopping room
+// that still matter. It is called with reg.mu held.
+func (reg *roomRegistry) keepState(r *room) {
+	now := time.Now()
+	state := roomState{muted: make(map[string]time.Time), lastPosted: make(map[string]time.Time)}
+	for userID, until := range r.muted {
+		if until.After(now) {
+			state.muted[userID] = until
+		}
+	}
+	interval := time.Duration(r.settings.SlowMode) * time.Second
+	for userID, last := range r.lastPosted {
+		if last.Add(interval).After(now) {
+			state.lastPosted[userID] = last
+		}
+	}
+	if len(state.muted) == 0 && len(state.lastPosted) == 0 {
+		delete(reg.stopped, r.name)
+		return
+	}
+	reg.stopped[r.name] = state
+}
+
+// restoreState gives the starting room the state it had when it last
+// stopped. It is called with reg.mu held.
+func (reg *roomRegistry) restoreState(r *room) {
+	state, ok := reg.stopped[r.name]
+	if !ok {
+		return
+	}
+	delete(reg.stopped, r.name)
+	r.muted, r.lastPosted = state.muted, state.lastPosted
+}
+
+// enter joins the client to the room, following the room if it was
+// revived after stopping for being idle. It returns the room the
+// client joined.
+func (r *room) enter(c *client) (*room, error) {
+	for {
+		select {
+		case r.join <- c:
+			return r, nil
+		case <-r.done:
+			// the room stopped just as we got here, the registry
+			// starts it up again from storage
+			revived, err := r.registry.get(r.name)
+			if err != nil {
+				return nil, err
+			}
+			r = revived
+			c.room = r
+		}
+	}
+}
+
+// exit takes the client out of the room, unless the room has
+// already stopped.
+func (r *room) exit(c *client) {
+	select {
+	case r.leave <- c:
+	case <-r.done:
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIdleRoomStopsAndRevives(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := loadRoomStore(filepath.Join(dir, "rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(roomConfig{Name: "idle", Visibility: visibilityPublic})
+
+	reg := newRoomRegistry(store)
+	reg.idleTimeout = 10 * time.Millisecond
+
+	r, err := reg.get("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("an empty room should stop after the idle timeout")
+	}
+
+	revived, err := reg.get("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revived == r {
+		t.Error("get should start a new room once the old one stopped")
+	}
+
+	// joining a stopped room ends up in the revived one
+	c := newTestClient("abc")
+	c.room = r
+	joined, err := r.enter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined != revived || c.room != revived {
+		t.Error("enter should follow the room to the revived one")
+	}
+}
+
+func TestIdleRoomKeepsMutes(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	rooms.idleTimeout = 10 * time.Millisecond
+	rooms.store.SetSettings(mainRoom, roomSettings{SlowMode: 60})
+
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles.SetRoom(mainRoom, "mod", roleModerator)
+	mod, poster := newTestClient("mod"), newTestClient("xyz")
+	for _, c := range []*client{mod, poster} {
+		c.room = r
+		if _, err := r.enter(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod.submit(&message{Message: "/mute abc 1h"})
+	mod.submit(&message{Message: "/mute old 1ns"})
+	poster.submit(&message{Message: "hi"})
+	r.exit(mod)
+	r.exit(poster)
+
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("an empty room should stop after the idle timeout")
+	}
+	rooms.idleTimeout = 0
+	revived, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revived.isMuted("abc") || revived.isMuted("old") {
+		t.Errorf("only the running mutes should be kept, got %v", revived.muted)
+	}
+	if wait := revived.slowModeWait("xyz"); wait <= 0 {
+		t.Error("slow mode should still hold the user back after the room was revived")
+	}
+}
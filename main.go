@@ -1,184 +1,410 @@
-package main
-
-import (
-	"simple-go-chat/trace"
-	"flag"
-	"fmt"
-	"github.com/stretchr/gomniauth/providers/facebook"
-	"github.com/stretchr/gomniauth/providers/github"
-	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
-	"html/template"
-	"log"
-	"net/http"
-	"path/filepath"
-	"sync"
-)
-
-type templateHandler struct {
-
-	// compile the template once
-	once sync.Once
-
-	// take a filename string
-	filename string
-
-	// keep the reference to the compiled template, and then respond to HTTP requests
-	templ *template.Template
-}
-
-// ServeHTTP handles the HTTP request.
-func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	// memastikan web server hanya akan di-compile sekali saja
-	t.once.Do(func() {
-		t.templ = template.Must(template.ParseFiles(filepath.Join("template/", t.filename)))
-	})
-
-	/*
-		Presenting User Data
-
-		Tampilkan User Information yang diperoleh setelah Sign In menggunakan User Information
-		Sosial Media tertentu
-	*/
-
-	data := map[string]interface{}{
-		"Host": r.Host,
-	}
-	if authCookie, err := r.Cookie("auth"); err == nil {
-		data["UserData"] = objx.MustFromBase64(authCookie.Value)
-	}
-
-	t.templ.Execute(w, data)
-
-	// t.templ.Execute(w, r)
-}
-
-func main() {
-
-	/*
-		setup gomniauth
-
-		setelah mendaftarkan website kita pada social media tertentu, maka kita
-		akan memperoleh security key dan secret.
-
-		You should replace the key and secret placeholders with the actual values you noted
-		down earlier. The third argument represents the callback URL that should match the ones
-		you provided when creating your clients on the provider's website. Notice the second path
-		segment is callback; while we haven't implemented this yet, this is where we handle the
-		response from the authorization process.
-
-		Gomniauth requires the SetSecurityKey call because it sends state data between
-		the client and server along with a signature checksum, which ensures that the
-		state values are not tempered with while being transmitted. The security key is
-		used when creating the hash in a way that it is almost impossible to recreate
-		the same hash without knowing the exact security key. You should replace some
-		long key with a security hash or phrase of your choice
-	*/
-
-	gomniauth.SetSecurityKey("PUT YOUR AUTH KEY HERE")
-
-	gomniauth.WithProviders(
-		facebook.New("key", "secret",
-			"http://localhost:8080/auth/callback/facebook"),
-		github.New("key", "secret",
-			"http://localhost:8080/auth/callback/github"),
-		google.New("key", "secret",
-			"http://localhost:8080/auth/callback/google"),
-	)
-
-	/*
-		The call to flag.String returns a type of *string, which is to say it returns
-		the address of a string variable where the value of the flag is stored. To get
-		the value itself (and not the address of the value), we must use the pointer
-		indirection operator, *.
-	*/
-	var addr = flag.String("addr", ":8081", "The addr of the application.")
-	flag.Parse() // parse the flags
-
-	// create a new room
-	// r := newRoom()
-
-	// r := newRoom(UseGravatar)
-
-	// r := newRoom(UseFileSystemAvatar)
-	// r.tracer = tracer.New(os.Stdout)
-
-	// set the active Avatar implementation
-	// var avatars Avatar = UseFileSystemAvatar
-
-	var avatars Avatar = TryAvatars{
-		UseFileSystemAvatar,
-		UseAuthAvatar,
-		UseGravatar
-	}
-
-	/*
-		The templateHandler structure is a valid http.Handler type so we can pass it directly to
-		the http.Handle function and ask it to handle requests that match the specified pattern
-	*/
-	// http.Handle("/", &templateHandler{filename: "chat.html"})
-
-	/*
-		Setelah penambahan autentifikasi
-
-		templateHandler yang seharusnya langsung reload page chat.html, akan melalui sebuah handler
-		lainnya, yaitu authHandler. MustAuth memaksa templateHandler dieksekui setelah authHandler.
-	*/
-	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"}))
-
-	/*
-		Login Page
-	*/
-	http.Handle("/login", &templateHandler{filename: "login.html"})
-
-	/*
-		Our loginHandler is only a function and not an object that implements the http.Handler
-		interface.  This is because, unlike other handlers, we don't need it to store any state.
-		The Go standard library supports this, so we can use the http.HandleFunc function to map
-		it in a way similar to how we used http.Handle earlier
-
-		Apakah beda http.Handle dan http.HandleFunc ??
-	*/
-	http.HandleFunc("/auth/", loginHandler)
-
-	http.Handle("/room", r)
-
-	http.Handle("/upload", MustAuth(&templateHandler{filename: "upload.html"}))
-
-	http.HandleFunc("/uploader", uploaderHandler)
-
-	http.Handle("/avatars/",
-		http.StripPrefix("/avatars/",
-			http.FileServer(http.Dir("./avatars"))))
-
-	/*
-		Logout Handler
-
-		Untuk mereset user yang login, agara bisa login ulang
-	*/
-	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "auth",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
-		w.Header().Set("Location", "/chat")
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	})
-
-	// get the room going
-	go r.run()
-
-	// start the web server
-	fmt.Println("starting web server at ", *addr)
-	log.Println("Starting web server on ", *addr)
-
-	// http.ListenAndServe(":8081", nil)
-	err := http.ListenAndServe(*addr, nil)
-
-	if err != nil {
-		log.Fatal("ListenAndServe:", err)
-	}
-}
+package main
+
+import (
+	"simple-go-chat/trace"
+	"compress/flate"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// set the active Avatar implementation
+// var avatars Avatar = UseFileSystemAvatar
+
+var avatars Avatar = TryAvatars{
+	UseFileSystemAvatar,
+	UseAuthAvatar,
+	UseGravatar,
+}
+
+// bans is the durable list of banned users, checked at login and
+// whenever a client joins the room.
+var bans *banList
+
+// roles holds the global and per room roles of every user.
+var roles *roleStore
+
+// rooms keeps the running rooms along with their stored settings.
+var rooms *roomRegistry
+
+type templateHandler struct {
+
+	// compile the template once
+	once sync.Once
+
+	// take a filename string
+	filename string
+
+	// keep the reference to the compiled template, and then respond to HTTP requests
+	templ *template.Template
+}
+
+// page is a template that is compiled the first time it is shown,
+// for handlers that fill in data of their own.
+type page struct {
+	once     sync.Once
+	filename string
+	templ    *template.Template
+	err      error
+}
+
+// render writes the page with the status. If the template cannot be
+// used nothing is written and the error is returned.
+func (p *page) render(w http.ResponseWriter, status int, data interface{}) error {
+	p.once.Do(func() {
+		p.templ, p.err = template.ParseFiles(filepath.Join("template", p.filename))
+	})
+	if p.err != nil {
+		return p.err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	p.templ.Execute(w, data)
+	return nil
+}
+
+// ServeHTTP handles the HTTP request.
+func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// memastikan web server hanya akan di-compile sekali saja
+	t.once.Do(func() {
+		t.templ = template.Must(template.ParseFiles(filepath.Join("template/", t.filename)))
+	})
+
+	/*
+		Presenting User Data
+
+		Tampilkan User Information yang diperoleh setelah Sign In menggunakan User Information
+		Sosial Media tertentu
+	*/
+
+	data := map[string]interface{}{
+		"Host": r.Host,
+		"Room": mainRoom,
+	}
+	if name := r.URL.Query().Get("room"); name != "" {
+		data["Room"] = name
+	}
+	data["CSRF"] = csrfToken(w, r)
+	data["Local"] = localAccounts
+	data["Register"] = allowRegister
+	data["Providers"] = loginProviders
+	data["Settings"] = roomSettings{}
+	if cfg, ok := rooms.store.Room(data["Room"].(string)); ok {
+		data["Settings"] = cfg.Settings
+	}
+	if userData, err := authUserData(r); err == nil {
+		data["UserData"] = userData
+		if userID, _ := userData["userid"].(string); directory != nil {
+			if u, ok := directory.User(userID); ok {
+				data["Profile"] = u
+			}
+		}
+	}
+
+	t.templ.Execute(w, data)
+
+	// t.templ.Execute(w, r)
+}
+
+func main() {
+
+	/*
+		The call to flag.String returns a type of *string, which is to say it returns
+		the address of a string variable where the value of the flag is stored. To get
+		the value itself (and not the address of the value), we must use the pointer
+		indirection operator, *.
+	*/
+	var addr = flag.String("addr", ":8081", "The addr of the application.")
+	var bansFile = flag.String("bans", "bans.json", "The file the ban list is kept in.")
+	var auditFile = flag.String("audit", "audit.log", "The file moderation actions are logged to.")
+	var rolesFile = flag.String("roles", "roles.json", "The file user roles are kept in.")
+	var defaultRole = flag.String("default-role", "member", "The role of users without an assigned role.")
+	var owners = flag.String("owners", "", "Comma separated unique IDs of the server owners.")
+	var roomsFile = flag.String("rooms", "rooms.json", "The file rooms and their members are kept in.")
+	var brokerKind = flag.String("broker", "memory", "How rooms are shared between nodes, memory or redis.")
+	var redisAddr = flag.String("redis-addr", "localhost:6379", "The addr of the Redis server used by the redis broker.")
+	var node = flag.String("node", defaultNodeID(), "The name of this node, unique among the nodes sharing rooms.")
+	var presenceTTL = flag.Duration("presence-ttl", 30*time.Second, "How long a node without heartbeats keeps its users online.")
+	var shards = flag.Int("fanout-shards", runtime.NumCPU(), "How many goroutines each room uses to send messages to its clients.")
+	var roomIdle = flag.Duration("room-idle", 10*time.Minute, "How long an empty room keeps running, 0 keeps rooms running forever.")
+	var compress = flag.Bool("compress", true, "Offer permessage-deflate compression to web socket clients.")
+	var compressLevel = flag.Int("compress-level", flate.BestSpeed, "The flate compression level, -2 (Huffman only) to 9 (best compression).")
+	var compressThreshold = flag.Int("compress-threshold", 512, "The size in bytes from which messages are compressed.")
+	var apiTokensFile = flag.String("api-tokens", "api_tokens.json", "The file mapping REST API tokens to the users they act as.")
+	var userTokensFile = flag.String("user-tokens", "user_tokens.json", "The file the hashes of the API tokens made by users are kept in.")
+	var historySize = flag.Int("history", defaultHistoryLimit, "How many messages of each room are kept for the REST API.")
+	var cookieKeysFile = flag.String("cookie-keys", "cookie_keys.json", "The file the keys signing the auth cookies are kept in.")
+	var cookieEncrypt = flag.Bool("cookie-encrypt", false, "Encrypt the auth cookies as well as signing them.")
+	var cookieRotate = flag.Duration("cookie-rotate", 7*24*time.Hour, "How often a new key starts signing auth cookies, 0 never rotates.")
+	var sessionKind = flag.String("sessions", "memory", "Where sessions are kept, memory or sqlite.")
+	var sessionsDB = flag.String("sessions-db", "sessions.db", "The SQLite database sessions are kept in.")
+	var sessionLife = flag.Duration("session-ttl", sessionTTL, "How long a session lasts without being used.")
+	var usersFile = flag.String("users", "users.json", "The file users and their linked logins are kept in.")
+	var accountsFile = flag.String("accounts", "accounts.json", "The file local accounts are kept in.")
+	var authConfigFile = flag.String("auth-config", "auth.json", "The file login providers and their secrets are configured in.")
+	var grpcAddr = flag.String("grpc-addr", ":9090", "The addr of the gRPC server, empty to turn it off.")
+	var traceRooms = flag.Bool("trace", false, "Trace room activity to standard output.")
+	flag.Parse() // parse the flags
+
+	var err error
+	if err := setCompression(*compress, *compressLevel, *compressThreshold); err != nil {
+		log.Fatalln("Invalid compression flags", "-", err)
+	}
+
+	/*
+		setup gomniauth
+
+		setelah mendaftarkan website kita pada social media tertentu, maka kita
+		akan memperoleh security key dan secret.
+
+		You should replace the key and secret placeholders with the actual values you noted
+		down earlier. The third argument represents the callback URL that should match the ones
+		you provided when creating your clients on the provider's website. Notice the second path
+		segment is callback; while we haven't implemented this yet, this is where we handle the
+		response from the authorization process.
+
+		Gomniauth requires the SetSecurityKey call because it sends state data between
+		the client and server along with a signature checksum, which ensures that the
+		state values are not tempered with while being transmitted. The security key is
+		used when creating the hash in a way that it is almost impossible to recreate
+		the same hash without knowing the exact security key. You should replace some
+		long key with a security hash or phrase of your choice
+
+		Key, secret, security key dan callback URL sekarang dibaca dari -auth-config
+		dan environment variable (lihat config.go), bukan ditulis di sini.
+	*/
+	authCfg, err := loadAuthConfig(*authConfigFile, os.Getenv)
+	if err != nil {
+		log.Fatalln("Invalid auth config", "-", err)
+	}
+	authCfg.apply()
+
+	bans, err = loadBanList(*bansFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load the ban list", "-", err)
+	}
+
+	fallback, err := parseRole(*defaultRole)
+	if err != nil {
+		log.Fatalln("Invalid -default-role", "-", err)
+	}
+	roles, err = loadRoleStore(*rolesFile, fallback)
+	if err != nil {
+		log.Fatalln("Error when trying to load roles", "-", err)
+	}
+	for _, userID := range strings.Split(*owners, ",") {
+		if userID != "" && roles.Role("", userID) != roleOwner {
+			if err := roles.SetGlobal(userID, roleOwner); err != nil {
+				log.Fatalln("Error when trying to save roles", "-", err)
+			}
+		}
+	}
+
+	authCookies, err = loadCookieCodec(*cookieKeysFile, *cookieEncrypt, *cookieRotate)
+	if err != nil {
+		log.Fatalln("Error when trying to load the cookie keys", "-", err)
+	}
+	go authCookies.rotate(time.Hour)
+
+	sessionTTL = *sessionLife
+	switch *sessionKind {
+	case "memory":
+	case "sqlite":
+		store, err := openSQLiteSessions(*sessionsDB)
+		if err != nil {
+			log.Fatalln("Error when trying to open the sessions database", "-", err)
+		}
+		defer store.Close()
+		sessions = store
+	default:
+		log.Fatalln("Unknown -sessions", *sessionKind)
+	}
+	go expireSessions(time.Hour)
+
+	directory, err = loadUserDirectory(*usersFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load users", "-", err)
+	}
+
+	accounts, err = loadAccounts(*accountsFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load accounts", "-", err)
+	}
+
+	apiTokens, err = loadAPITokens(*apiTokensFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load API tokens", "-", err)
+	}
+
+	userTokens, err = loadUserTokens(*userTokensFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load user tokens", "-", err)
+	}
+
+	auditLog, err := os.OpenFile(*auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalln("Error when trying to open the audit log", "-", err)
+	}
+	defer auditLog.Close()
+
+	// create a new room
+	// r := newRoom()
+
+	// r := newRoom(UseGravatar)
+
+	// r := newRoom(UseFileSystemAvatar)
+	// r.tracer = tracer.New(os.Stdout)
+
+	roomStore, err := loadRoomStore(*roomsFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load rooms", "-", err)
+	}
+	if _, ok := roomStore.Room(mainRoom); !ok {
+		err := roomStore.Create(roomConfig{Name: mainRoom, Visibility: visibilityPublic, Created: time.Now()})
+		if err != nil {
+			log.Fatalln("Error when trying to create the main room", "-", err)
+		}
+	}
+
+	rooms = newRoomRegistry(roomStore)
+	rooms.bans = bans
+	rooms.roles = roles
+	rooms.audit = trace.New(auditLog)
+	if *traceRooms {
+		rooms.tracer = trace.New(os.Stdout)
+	}
+	rooms.idleTimeout = *roomIdle
+	rooms.shards = *shards
+	rooms.history = newMessageHistory(*historySize)
+
+	switch *brokerKind {
+	case "memory":
+		rooms.broker = newMemoryBroker()
+		rooms.presence = newMemoryPresence(*node, *presenceTTL)
+	case "redis":
+		broker, err := newRedisBroker(*redisAddr)
+		if err != nil {
+			log.Fatalln("Error when trying to connect to Redis", "-", err)
+		}
+		rooms.broker = broker
+		rooms.presence = newRedisPresence(*redisAddr, *node, *presenceTTL)
+	default:
+		log.Fatalln("Unknown -broker", *brokerKind)
+	}
+	rooms.presence = newAsyncPresence(rooms.presence, trace.New(os.Stderr))
+	go heartbeat(rooms.presence, *presenceTTL/3, trace.New(os.Stderr))
+	rooms.watchSessions()
+
+	/*
+		The templateHandler structure is a valid http.Handler type so we can pass it directly to
+		the http.Handle function and ask it to handle requests that match the specified pattern
+	*/
+	// http.Handle("/", &templateHandler{filename: "chat.html"})
+
+	/*
+		Setelah penambahan autentifikasi
+
+		templateHandler yang seharusnya langsung reload page chat.html, akan melalui sebuah handler
+		lainnya, yaitu authHandler. MustAuth memaksa templateHandler dieksekui setelah authHandler.
+	*/
+	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"}))
+
+	/*
+		Login Page
+	*/
+	http.Handle("/login", &templateHandler{filename: "login.html"})
+
+	/*
+		Our loginHandler is only a function and not an object that implements the http.Handler
+		interface.  This is because, unlike other handlers, we don't need it to store any state.
+		The Go standard library supports this, so we can use the http.HandleFunc function to map
+		it in a way similar to how we used http.Handle earlier
+
+		Apakah beda http.Handle dan http.HandleFunc ??
+	*/
+	http.HandleFunc("/auth/", loginHandler)
+
+	// local accounts, for servers that cannot reach the providers
+	http.Handle("/register", &templateHandler{filename: "register.html"})
+	http.Handle("/password", MustAuth(&templateHandler{filename: "password.html"}))
+	http.HandleFunc("/accounts/register", csrfProtect(registerHandler))
+	http.HandleFunc("/accounts/login", csrfProtect(localLoginHandler))
+	http.HandleFunc("/accounts/password", csrfProtect(passwordHandler))
+	http.HandleFunc("/twofactor", twoFactorHandler)
+	http.HandleFunc("/accounts/2fa/setup", csrfProtect(twoFactorSetupHandler))
+	http.HandleFunc("/accounts/2fa/enable", csrfProtect(twoFactorEnableHandler))
+	http.HandleFunc("/accounts/2fa/verify", csrfProtect(twoFactorVerifyHandler))
+	http.HandleFunc("/accounts/2fa/disable", csrfProtect(twoFactorDisableHandler))
+
+	// the logins linked to a user
+	http.Handle("/profile", MustAuth(&templateHandler{filename: "profile.html"}))
+	http.HandleFunc("/profile/unlink", csrfProtect(unlinkHandler))
+
+	// the API tokens a user made for bots and scripts
+	http.Handle("/tokens", MustAuth(http.HandlerFunc(tokensHandler)))
+	http.HandleFunc("/tokens/create", csrfProtect(createTokenHandler))
+	http.HandleFunc("/tokens/revoke", csrfProtect(revokeTokenHandler))
+
+	http.Handle("/room", rooms)
+	// fallbacks for browsers that cannot keep a web socket open
+	http.HandleFunc("/room/events", eventsHandler)
+	http.HandleFunc("/room/poll", pollHandler)
+	http.HandleFunc("/room/send", sendHandler)
+	go transports.expire()
+
+	// REST API for scripts and integrations
+	http.HandleFunc("/api/v1/", apiHandler)
+
+	http.HandleFunc("/rooms/create", csrfProtect(createRoomHandler))
+	http.HandleFunc("/rooms/invite", csrfProtect(inviteHandler))
+	http.HandleFunc("/rooms/members", csrfProtect(membersHandler))
+	http.HandleFunc("/rooms/settings", csrfProtect(settingsHandler))
+	http.HandleFunc("/rooms/info", roomInfoHandler)
+	http.HandleFunc("/rooms/presence", presenceHandler)
+	http.Handle("/invite/", MustAuth(http.HandlerFunc(redeemInviteHandler)))
+
+	http.Handle("/upload", MustAuth(&templateHandler{filename: "upload.html"}))
+
+	http.HandleFunc("/uploader", csrfProtect(uploaderHandler))
+
+	http.Handle("/avatars/",
+		http.StripPrefix("/avatars/",
+			http.FileServer(http.Dir("./avatars"))))
+
+	/*
+		Logout Handler
+
+		Untuk mereset user yang login, agara bisa login ulang
+	*/
+	http.HandleFunc("/logout", csrfProtect(logoutHandler))
+
+	// start the gRPC server for backend services
+	if *grpcAddr != "" {
+		go func() {
+			log.Println("Starting gRPC server on ", *grpcAddr)
+			if err := serveGRPC(*grpcAddr); err != nil {
+				log.Fatal("gRPC:", err)
+			}
+		}()
+	}
+
+	// start the web server
+	fmt.Println("starting web server at ", *addr)
+	log.Println("Starting web server on ", *addr)
+
+	// http.ListenAndServe(":8081", nil)
+	err = http.ListenAndServe(*addr, nil)
+
+	if err != nil {
+		log.Fatal("ListenAndServe:", err)
+	}
+}
@@ -1,20 +1,53 @@
-package main
-
-import (
-	"time"
-)
-
-// message represents a single message
-/*
-	pesan yang terkirim membawa 3 variabel di bawah ini
-	1. Name
-	2. Message
-	3. When
-	4. AvatarURL (Profile Picture)
-*/
-type message struct {
-	Name      string
-	Message   string
-	When      time.Time
-	AvatarURL string
-}
+package main
+
+import (
+	"time"
+)
+
+// message represents a single message
+/*
+	pesan yang terkirim membawa variabel di bawah ini
+	1. Name
+	2. Message
+	3. When
+	4. AvatarURL (Profile Picture)
+	5. UserID (unique ID pengirim)
+	6. System (pesan dari server, misalnya hasil moderasi)
+	7. Settings (setting room yang baru, bila ada perubahan)
+*/
+type message struct {
+	Name      string
+	Message   string
+	When      time.Time
+	AvatarURL string
+	UserID    string
+	System    bool
+	Settings  *roomSettings `json:",omitempty"`
+
+	// from is the client that sent the message, nil for messages
+	// made by the server.
+	from *client
+	// frames holds the message encoded for each frame format.
+	frames [numFormats]encodedFrame
+	// posted, if set, is told whether the room accepted the message.
+	posted chan error
+}
+
+// newSystemMessage makes a message sent by the server itself rather
+// than by one of the users.
+func newSystemMessage(text string) *message {
+	return &message{
+		Name:    "system",
+		Message: text,
+		When:    time.Now(),
+		System:  true,
+	}
+}
+
+// answer tells whoever is waiting on the message whether the room
+// accepted it.
+func (m *message) answer(err error) {
+	if m.posted != nil {
+		m.posted <- err
+	}
+}
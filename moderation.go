@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMuteDuration is used when /mute is given no duration.
+const defaultMuteDuration = 10 * time.Minute
+
+// ban records who was banned, by whom and why.
+type ban struct {
+	UserID string
+	By     string
+	Reason string
+	When   time.Time
+}
+
+// banList is the durable list of banned users, keyed by unique ID.
+// Every change is written straight back to the file it was loaded
+// from so bans survive a restart.
+type banList struct {
+	mu   sync.RWMutex
+	path string
+	bans map[string]ban
+}
+
+// loadBanList reads the ban list stored at path. A missing file
+// gives an empty list.
+func loadBanList(path string) (*banList, error) {
+	b := &banList{path: path, bans: make(map[string]ban)}
+	if err := loadJSON(path, &b.bans); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsBanned reports whether the user with the given unique ID is banned.
+func (b *banList) IsBanned(userID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.bans[userID]
+	return ok
+}
+
+// Ban adds the entry to the list and saves it.
+func (b *banList) Ban(entry ban) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[entry.UserID] = entry
+	return saveJSON(b.path, b.bans)
+}
+
+// Unban removes the user from the list and saves it.
+func (b *banList) Unban(userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bans, userID)
+	return saveJSON(b.path, b.bans)
+}
+
+// command is a slash command typed into the chat box by a client,
+// for example "/mute Mat 5m".
+type command struct {
+	client *client
+	name   string
+	args   []string
+}
+
+// parseCommand turns text starting with a slash into a command.
+func parseCommand(c *client, text string) (*command, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, false
+	}
+	fields := strings.Fields(text[1:])
+	if len(fields) == 0 {
+		return nil, false
+	}
+	return &command{client: c, name: strings.ToLower(fields[0]), args: fields[1:]}, true
+}
+
+// handleCommand carries out a slash command. It runs inside the room
+// goroutine, so it can touch r.clients and r.muted just like run does.
+func (r *room) handleCommand(cmd *command) {
+	if !hasScope(cmd.client.userData, scopeAdmin) {
+		r.notify(cmd.client.userID(), "Your API token cannot use /"+cmd.name)
+		return
+	}
+	if cmd.name == "topic" || cmd.name == "set" {
+		r.handleSettingsCommand(cmd)
+		return
+	}
+
+	needed := permModerate
+	if cmd.name == "role" {
+		needed = permManageRoles
+	}
+	if !r.can(cmd.client.userID(), needed) {
+		r.notify(cmd.client.userID(), "You are not allowed to use /"+cmd.name)
+		return
+	}
+	if len(cmd.args) == 0 {
+		r.notify(cmd.client.userID(), "Usage: /"+cmd.name+" <user> ...")
+		return
+	}
+
+	userID, name := r.resolveUser(cmd.args[0])
+
+	// nobody can act on a user with the same or a higher role
+	actorRole := r.roles.Role(r.name, cmd.client.userID())
+	if r.roles.Role(r.name, userID) >= actorRole {
+		r.notify(cmd.client.userID(), "You cannot use /"+cmd.name+" on "+name)
+		return
+	}
+
+	// bans lock the user out of the whole server, so they are for
+	// server moderators only, not the owner of any room
+	if cmd.name == "ban" || cmd.name == "unban" {
+		global := r.roles.Role("", cmd.client.userID())
+		if !global.can(permModerate) || r.roles.Role("", userID) >= global {
+			r.notify(cmd.client.userID(), "Only server moderators can use /"+cmd.name+" on "+name)
+			return
+		}
+	}
+
+	switch cmd.name {
+	case "kick":
+		r.kick(userID)
+		r.logAction(cmd.client, "%s was kicked by %s", name, cmd.client.name())
+
+	case "mute":
+		duration := defaultMuteDuration
+		if len(cmd.args) > 1 {
+			d, err := time.ParseDuration(cmd.args[1])
+			if err != nil || d <= 0 {
+				r.notify(cmd.client.userID(), "Invalid duration: "+cmd.args[1])
+				return
+			}
+			duration = d
+		}
+		r.muted[userID] = time.Now().Add(duration)
+		r.logAction(cmd.client, "%s was muted for %s by %s", name, duration, cmd.client.name())
+
+	case "unmute":
+		delete(r.muted, userID)
+		r.logAction(cmd.client, "%s was unmuted by %s", name, cmd.client.name())
+
+	case "ban":
+		err := r.bans.Ban(ban{
+			UserID: userID,
+			By:     cmd.client.userID(),
+			Reason: strings.Join(cmd.args[1:], " "),
+			When:   time.Now(),
+		})
+		if err != nil {
+			r.notify(cmd.client.userID(), "Failed to save ban: "+err.Error())
+			return
+		}
+		r.kick(userID)
+		r.logAction(cmd.client, "%s was banned by %s", name, cmd.client.name())
+
+	case "unban":
+		if err := r.bans.Unban(userID); err != nil {
+			r.notify(cmd.client.userID(), "Failed to save ban: "+err.Error())
+			return
+		}
+		r.logAction(cmd.client, "%s was unbanned by %s", name, cmd.client.name())
+
+	case "role":
+		// /role <user> <role> [global]
+		if len(cmd.args) < 2 {
+			r.notify(cmd.client.userID(), "Usage: /role <user> <role> [global]")
+			return
+		}
+		newRole, err := parseRole(cmd.args[1])
+		if err != nil || newRole >= actorRole {
+			r.notify(cmd.client.userID(), "You cannot assign the role "+cmd.args[1])
+			return
+		}
+		global := len(cmd.args) > 2 && cmd.args[2] == "global"
+		if global {
+			if !r.roles.Role("", cmd.client.userID()).can(permManageRoles) {
+				r.notify(cmd.client.userID(), "You are not allowed to assign global roles")
+				return
+			}
+			err = r.roles.SetGlobal(userID, newRole)
+		} else {
+			err = r.roles.SetRoom(r.name, userID, newRole)
+		}
+		if err != nil {
+			r.notify(cmd.client.userID(), "Failed to save role: "+err.Error())
+			return
+		}
+		r.logAction(cmd.client, "%s is now %s, set by %s", name, newRole, cmd.client.name())
+
+	default:
+		r.notify(cmd.client.userID(), "Unknown command /"+cmd.name)
+	}
+}
+
+// resolveUser finds the user a moderator meant. Users currently in the
+// room can be named by display name, anyone else by unique ID.
+func (r *room) resolveUser(arg string) (userID, name string) {
+	for client := range r.clients {
+		if client.name() == arg || client.userID() == arg {
+			return client.userID(), client.name()
+		}
+	}
+	return arg, arg
+}
+
+// kick disconnects every client belonging to the user. The fanout closes
+// the send channel, which stops client.write, which closes the socket and
+// in turn ends client.read.
+func (r *room) kick(userID string) {
+	for client := range r.clients {
+		if client.userID() == userID {
+			delete(r.clients, client)
+			r.fanout.remove(client)
+			r.forgetWaiting(client)
+			r.trackLeave(client)
+		}
+	}
+	r.admitWaiting()
+	r.countOccupancy()
+}
+
+// isMuted reports whether the user is currently muted, forgetting
+// mutes that have run out.
+func (r *room) isMuted(userID string) bool {
+	until, ok := r.muted[userID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(r.muted, userID)
+		return false
+	}
+	return true
+}
+
+// notify sends a system message to the clients of one user only.
+func (r *room) notify(userID, text string) {
+	msg := newSystemMessage(text)
+	for client := range r.clients {
+		if client.userID() == userID {
+			r.fanout.send(client, msg)
+		}
+	}
+}
+
+// logAction announces a moderation action to everyone in the room and
+// records it in the audit log.
+func (r *room) logAction(by *client, format string, a ...interface{}) {
+	text := fmt.Sprintf(format, a...)
+	r.publish(newSystemMessage(text))
+	r.audit.Trace(time.Now().Format(time.RFC3339), " [", by.userID(), "] ", text)
+}
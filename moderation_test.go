@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bans.json")
+
+	bans, err := loadBanList(filename)
+	if err != nil {
+		t.Fatalf("loadBanList should not fail for a missing file: %s", err)
+	}
+	if bans.IsBanned("abc") {
+		t.Error("IsBanned should be false for an empty list")
+	}
+
+	if err := bans.Ban(ban{UserID: "abc", By: "mod", When: time.Now()}); err != nil {
+		t.Fatalf("Ban should not return an error: %s", err)
+	}
+
+	// the ban must survive reloading from disk
+	bans, err = loadBanList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bans.IsBanned("abc") {
+		t.Error("IsBanned should be true after Ban")
+	}
+
+	if err := bans.Unban("abc"); err != nil {
+		t.Fatalf("Unban should not return an error: %s", err)
+	}
+	if bans.IsBanned("abc") {
+		t.Error("IsBanned should be false after Unban")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+
+	if _, ok := parseCommand(nil, "hello"); ok {
+		t.Error("parseCommand should ignore normal messages")
+	}
+
+	cmd, ok := parseCommand(nil, "/Mute Mat 5m")
+	if !ok {
+		t.Fatal("parseCommand should parse a slash command")
+	}
+	if cmd.name != "mute" {
+		t.Errorf("parseCommand wrongly returned name %s", cmd.name)
+	}
+	if len(cmd.args) != 2 || cmd.args[0] != "Mat" || cmd.args[1] != "5m" {
+		t.Errorf("parseCommand wrongly returned args %v", cmd.args)
+	}
+}
+
+func TestBanNeedsServerModerator(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	rooms.store.Create(roomConfig{Name: "myroom", Visibility: visibilityPublic})
+	roles.SetRoom("myroom", "owner", roleOwner)
+	roles.SetGlobal("mod", roleModerator)
+
+	r, err := rooms.get("myroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, mod := newTestClient("owner"), newTestClient("mod")
+	for _, c := range []*client{owner, mod} {
+		c.room = r
+		if _, err := r.enter(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owner.submit(&message{Message: "/ban victim"})
+	select {
+	case msg := <-owner.send:
+		if !strings.HasPrefix(msg.Message, "Only server moderators") {
+			t.Errorf("the owner of a room should not ban from the server, got %q", msg.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the owner should be told why not")
+	}
+	if bans.IsBanned("victim") {
+		t.Fatal("the ban should not be saved")
+	}
+
+	mod.submit(&message{Message: "/ban victim"})
+	select {
+	case <-mod.send:
+	case <-time.After(time.Second):
+		t.Fatal("the ban should be announced")
+	}
+	if !bans.IsBanned("victim") {
+		t.Error("a server moderator should be able to ban")
+	}
+}
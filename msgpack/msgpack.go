@@ -0,0 +1,383 @@
+// Package msgpack is a small MessagePack encoder and decoder, covering
+// the types the chat protocol needs: nil, booleans, integers, floats,
+// strings, binary, arrays, maps with string keys and timestamps.
+package msgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrShort is returned when the data ends in the middle of a value.
+var ErrShort = errors.New("msgpack: unexpected end of data")
+
+// ErrTooDeep is returned when arrays and maps are nested deeper than
+// MaxDepth.
+var ErrTooDeep = errors.New("msgpack: values nested too deeply")
+
+// MaxDepth is how deeply Unmarshal lets arrays and maps nest, so
+// hostile data cannot run the decoder out of stack.
+const MaxDepth = 64
+
+// timestampExt is the extension type MessagePack uses for timestamps.
+const timestampExt = -1
+
+// AppendNil appends a nil.
+func AppendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+// AppendBool appends a boolean.
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+// AppendInt appends an integer in the smallest form that holds it.
+func AppendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return append(b, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return appendUint32(b, uint32(v))
+	}
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(v))
+}
+
+// AppendFloat appends a 64 bit float.
+func AppendFloat(b []byte, v float64) []byte {
+	b = append(b, 0xcb)
+	return appendUint64(b, math.Float64bits(v))
+}
+
+// AppendString appends a string.
+func AppendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
+
+// AppendBytes appends binary data.
+func AppendBytes(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xc6)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, data...)
+}
+
+// AppendArrayHeader appends the start of an array of n values, which
+// must follow.
+func AppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	}
+	b = append(b, 0xdd)
+	return appendUint32(b, uint32(n))
+}
+
+// AppendMapHeader appends the start of a map of n key value pairs,
+// which must follow.
+func AppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	}
+	b = append(b, 0xdf)
+	return appendUint32(b, uint32(n))
+}
+
+// AppendTime appends a timestamp, using the 96 bit form so any time
+// fits.
+func AppendTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff) // 0xff is the timestamp type, -1
+	b = appendUint32(b, uint32(t.Nanosecond()))
+	return appendUint64(b, uint64(t.Unix()))
+}
+
+// Unmarshal decodes a single value. Maps come back as
+// map[string]interface{}, arrays as []interface{}, integers as int64
+// (or uint64 when too big for one), floats as float64 and timestamps
+// as time.Time.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("msgpack: %d bytes left after the value", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads a big endian length of n bytes.
+func (d *decoder) length(n int) (int, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+func (d *decoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), data...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		data, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 0xcb:
+		data, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		data, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range data {
+			v = v<<8 | uint64(x)
+		}
+		if v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		data, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range data {
+			v = v<<8 | uint64(x)
+		}
+		// sign extend from the size that was read
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(n)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(n)
+	}
+	return nil, fmt.Errorf("msgpack: unknown type byte 0x%x", c)
+}
+
+func (d *decoder) str(n int) (interface{}, error) {
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// nest is called on entering an array or map, the returned function
+// on leaving it.
+func (d *decoder) nest() (func(), error) {
+	if d.depth >= MaxDepth {
+		return nil, ErrTooDeep
+	}
+	d.depth++
+	return func() { d.depth-- }, nil
+}
+
+func (d *decoder) arrayOf(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		// every value takes at least a byte
+		return nil, ErrShort
+	}
+	leave, err := d.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	list := make([]interface{}, n)
+	for i := range list {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func (d *decoder) mapOf(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, ErrShort
+	}
+	leave, err := d.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// ext decodes an extension value with n bytes of data. Only
+// timestamps are understood.
+func (d *decoder) ext(n int) (interface{}, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(t[0]) != timestampExt {
+		return nil, fmt.Errorf("msgpack: unknown extension type %d", int8(t[0]))
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data)
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)), nil
+	}
+	return nil, fmt.Errorf("msgpack: timestamp of %d bytes", n)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,109 @@
+package msgpack
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	when := time.Date(2024, 5, 17, 10, 30, 0, 123456789, time.UTC)
+	var b []byte
+	b = AppendMapHeader(b, 8)
+	b = AppendString(b, "nil")
+	b = AppendNil(b)
+	b = AppendString(b, "bool")
+	b = AppendBool(b, true)
+	b = AppendString(b, "ints")
+	b = AppendArrayHeader(b, 6)
+	for _, v := range []int64{0, -5, 200, -300, 70000, -1 << 40} {
+		b = AppendInt(b, v)
+	}
+	b = AppendString(b, "float")
+	b = AppendFloat(b, 1.5)
+	b = AppendString(b, "short")
+	b = AppendString(b, "hi")
+	b = AppendString(b, "long")
+	b = AppendString(b, strings.Repeat("x", 300))
+	b = AppendString(b, "bytes")
+	b = AppendBytes(b, []byte{1, 2, 3})
+	b = AppendString(b, "when")
+	b = AppendTime(b, when)
+
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unmarshal should not return an error: %s", err)
+	}
+	m, ok := got.(map[string]interface{})
+	if !ok {
+		t.Fatalf("Unmarshal should return a map, got %T", got)
+	}
+	want := map[string]interface{}{
+		"nil":   nil,
+		"bool":  true,
+		"ints":  []interface{}{int64(0), int64(-5), int64(200), int64(-300), int64(70000), int64(-1 << 40)},
+		"float": 1.5,
+		"short": "hi",
+		"long":  strings.Repeat("x", 300),
+		"bytes": []byte{1, 2, 3},
+	}
+	gotWhen, _ := m["when"].(time.Time)
+	delete(m, "when")
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Unmarshal wrongly returned %#v", m)
+	}
+	if !gotWhen.Equal(when) {
+		t.Errorf("timestamp came back as %v, want %v", gotWhen, when)
+	}
+}
+
+func TestCompactForms(t *testing.T) {
+
+	// small values use the single byte forms from the spec
+	if b := AppendInt(nil, 7); !bytes.Equal(b, []byte{0x07}) {
+		t.Errorf("AppendInt(7) = % x", b)
+	}
+	if b := AppendInt(nil, -1); !bytes.Equal(b, []byte{0xff}) {
+		t.Errorf("AppendInt(-1) = % x", b)
+	}
+	if b := AppendString(nil, "a"); !bytes.Equal(b, []byte{0xa1, 'a'}) {
+		t.Errorf(`AppendString("a") = % x`, b)
+	}
+	if b := AppendMapHeader(nil, 2); !bytes.Equal(b, []byte{0x82}) {
+		t.Errorf("AppendMapHeader(2) = % x", b)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+
+	for _, data := range [][]byte{
+		{},                 // nothing
+		{0xa5, 'a'},        // string cut short
+		{0x82, 0xa1, 'a'},  // map cut short
+		{0x81, 0x01, 0x01}, // map key that is not a string
+		{0x01, 0x02},       // data after the value
+		{0xc1},             // never used type byte
+	} {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("Unmarshal(% x) should return an error", data)
+		}
+	}
+
+	// arrays of one array, nested as deep as allowed and one deeper
+	nested := func(depth int) []byte {
+		data := bytes.Repeat([]byte{0x91}, depth)
+		return append(data, 0xc0)
+	}
+	if _, err := Unmarshal(nested(MaxDepth)); err != nil {
+		t.Errorf("nesting %d deep should be fine, got %v", MaxDepth, err)
+	}
+	if _, err := Unmarshal(nested(MaxDepth + 1)); err != ErrTooDeep {
+		t.Errorf("nesting deeper than MaxDepth should give ErrTooDeep, got %v", err)
+	}
+	if _, err := Unmarshal(nested(1 << 20)); err != ErrTooDeep {
+		t.Errorf("deeply nested data should give ErrTooDeep, got %v", err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Login dengan OpenID Connect provider apa saja (Keycloak, Dex, Azure AD,
+	Google, ...) tanpa harus ditulis satu per satu seperti provider
+	gomniauth. Endpoint dan key provider diambil dari discovery document
+	{issuer}/.well-known/openid-configuration, lalu ID token yang diterima
+	diperiksa: signature RS256, issuer, audience, nonce dan waktu kadaluarsa.
+*/
+
+// ErrInvalidIDToken is returned for ID tokens that do not check out.
+var ErrInvalidIDToken = errors.New("chat: Invalid ID token.")
+
+// oidcClockSkew is how far the clocks of the issuer and this server
+// may be apart.
+const oidcClockSkew = time.Minute
+
+// oidcDiscovery is the part of the discovery document used here.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the claims of an ID token.
+type oidcClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	Expires       int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Username      string   `json:"preferred_username"`
+	Picture       string   `json:"picture"`
+}
+
+// audience is the aud claim, which is either one string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(id string) bool {
+	for _, aud := range a {
+		if aud == id {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider logs users in with an OpenID Connect issuer.
+type oidcProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the issuer sends the user back to, empty
+	// uses /auth/callback/{name} on the host the login started on.
+	RedirectURL string
+	Scopes      []string
+
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	// fetched is when the keys were last fetched, so an unknown key
+	// ID does not make every request fetch them again.
+	fetched time.Time
+}
+
+func newOIDCProvider(name, issuer, clientID, clientSecret string) *oidcProvider {
+	return &oidcProvider{
+		Name:         name,
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"openid", "profile", "email"},
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// oidcProviders are the OpenID Connect providers by name.
+var oidcProviders = map[string]*oidcProvider{}
+
+// getJSON fetches url into v.
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover fetches the discovery document once.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("the discovery document is for issuer %q, not %q", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("the discovery document is missing endpoints")
+	}
+	p.discovery = &d
+	return &d, nil
+}
+
+// key gets the public key with the ID, fetching the keys again when
+// the issuer has rotated them.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.fetched) < time.Minute {
+		return nil, ErrInvalidIDToken
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.fetched = time.Now()
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidIDToken
+}
+
+// redirectURL is where the issuer sends the user back to.
+func (p *oidcProvider) redirectURL(r *http.Request) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/callback/" + p.Name
+}
+
+// AuthURL is where the user signs in with the issuer.
+func (p *oidcProvider) AuthURL(r *http.Request, state, nonce string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.redirectURL(r)},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the code the issuer sent the user back with for
+// the ID token.
+func (p *oidcProvider) Exchange(r *http.Request, code string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURL(r)},
+	}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", fmt.Errorf("the token request failed: %s %s", resp.Status, token.Error)
+	}
+	return token.IDToken, nil
+}
+
+// Verify checks the ID token was signed by the issuer for this client
+// and the login carrying nonce, and has not expired.
+func (p *oidcProvider) Verify(idToken, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	// only RS256, never whatever the token says, "none" included
+	if header.Alg != "RS256" {
+		return nil, ErrInvalidIDToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer,
+		!claims.Audience.contains(p.ClientID),
+		len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID,
+		claims.Subject == "",
+		claims.Nonce == "" || claims.Nonce != nonce,
+		now.After(time.Unix(claims.Expires, 0).Add(oidcClockSkew)),
+		now.Before(time.Unix(claims.IssuedAt, 0).Add(-oidcClockSkew)):
+		return nil, ErrInvalidIDToken
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// oidcUser is the ChatUser of an ID token.
+type oidcUser struct {
+	*oidcClaims
+	provider string
+}
+
+// UniqueID hashes the verified email like the other providers do, so
+// the same person gets the same ID. Without one the subject is only
+// unique at its issuer.
+func (u oidcUser) UniqueID() string {
+	m := md5.New()
+	if u.Email != "" && u.EmailVerified {
+		io.WriteString(m, strings.ToLower(u.Email))
+	} else {
+		io.WriteString(m, u.Issuer+"|"+u.Subject)
+	}
+	return fmt.Sprintf("%x", m.Sum(nil))
+}
+
+func (u oidcUser) Name() string {
+	switch {
+	case u.oidcClaims.Name != "":
+		return u.oidcClaims.Name
+	case u.Username != "":
+		return u.Username
+	case u.Email != "":
+		return u.Email
+	}
+	return u.Subject
+}
+
+func (u oidcUser) AvatarURL() string {
+	return u.Picture
+}
+
+// oidcLogin sends the user to sign in with the issuer, or to link
+// the issuer to their profile.
+func oidcLogin(w http.ResponseWriter, r *http.Request, p *oidcProvider) {
+	state, nonce, err := beginLogin(w, p.Name, linkTo(r))
+	if err != nil {
+		loginFailed(w, http.StatusInternalServerError, p.Name, err)
+		return
+	}
+	loginURL, err := p.AuthURL(r, state, nonce)
+	if err != nil {
+		loginFailed(w, http.StatusBadGateway, p.Name, fmt.Errorf("discovery: %s", err))
+		return
+	}
+	w.Header().Set("Location", loginURL)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// oidcCallback signs in the user the issuer sent back.
+func oidcCallback(w http.ResponseWriter, r *http.Request, p *oidcProvider) {
+	nonce, link, ok := finishLogin(w, r, p.Name, r.URL.Query().Get("state"))
+	if !ok {
+		renderError(w, http.StatusBadRequest, "Sign in failed",
+			"The sign in took too long or was started elsewhere, please try again.")
+		return
+	}
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		renderError(w, http.StatusForbidden, "Sign in failed", fmt.Sprintf("%s did not let you sign in: %s", p.Name, msg))
+		return
+	}
+
+	idToken, err := p.Exchange(r, r.URL.Query().Get("code"))
+	if err != nil {
+		loginFailed(w, http.StatusBadGateway, p.Name, fmt.Errorf("token: %s", err))
+		return
+	}
+	claims, err := p.Verify(idToken, nonce)
+	if err != nil {
+		loginFailed(w, http.StatusForbidden, p.Name, fmt.Errorf("ID token: %s", err))
+		return
+	}
+	completeLogin(w, r, oidcUser{claims, p.Name}, link)
+}
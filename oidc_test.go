@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID Connect issuer for tests.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// nonce is put in the ID tokens the token endpoint hands out.
+	nonce string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "chat" || secret != "secret" || r.FormValue("code") != "good" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]string{"id_token": m.token(t, "RS256", "test", m.claims(nil))})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// claims are valid claims for the chat client, with changes.
+func (m *mockIssuer) claims(changes map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            m.URL,
+		"sub":            "1234",
+		"aud":            "chat",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          m.nonce,
+		"email":          "Mat@Example.com",
+		"email_verified": true,
+		"name":           "Mat Ryer",
+	}
+	for k, v := range changes {
+		claims[k] = v
+	}
+	return claims
+}
+
+func (m *mockIssuer) token(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// emailID is the unique ID the providers give the email.
+func emailID(email string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(email)))
+}
+
+func TestOIDCVerify(t *testing.T) {
+
+	m := newMockIssuer(t)
+	defer m.Close()
+	m.nonce = "n0nce"
+	p := newOIDCProvider("mock", m.URL, "chat", "secret")
+
+	claims, err := p.Verify(m.token(t, "RS256", "test", m.claims(nil)), "n0nce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := (oidcUser{claims, "mock"}); u.Name() != "Mat Ryer" || u.UniqueID() != emailID("mat@example.com") {
+		t.Errorf("the claims wrongly gave %q %q", u.Name(), u.UniqueID())
+	}
+	claims.EmailVerified = false
+	if (oidcUser{claims, "mock"}).UniqueID() == emailID("mat@example.com") {
+		t.Error("an unverified email should not give the ID of its owner")
+	}
+
+	tampered := m.token(t, "RS256", "test", m.claims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	for name, token := range map[string]string{
+		"another audience":   m.token(t, "RS256", "test", m.claims(map[string]interface{}{"aud": "other"})),
+		"several audiences":  m.token(t, "RS256", "test", m.claims(map[string]interface{}{"aud": []string{"chat", "other"}})),
+		"another issuer":     m.token(t, "RS256", "test", m.claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"expired":            m.token(t, "RS256", "test", m.claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"issued in future":   m.token(t, "RS256", "test", m.claims(map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()})),
+		"another nonce":      m.token(t, "RS256", "test", m.claims(map[string]interface{}{"nonce": "replayed"})),
+		"another algorithm":  m.token(t, "HS256", "test", m.claims(nil)),
+		"unknown key":        m.token(t, "RS256", "other", m.claims(nil)),
+		"tampered signature": tampered,
+		"not a token":        "abc",
+		"unsigned":           "eyJhbGciOiJub25lIn0.e30.",
+	} {
+		if _, err := p.Verify(token, "n0nce"); err == nil {
+			t.Errorf("a token with %s should be refused", name)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+
+	m := newMockIssuer(t)
+	defer m.Close()
+	oidcProviders = map[string]*oidcProvider{"mock": newOIDCProvider("mock", m.URL, "chat", "secret")}
+	defer func() { oidcProviders = map[string]*oidcProvider{} }()
+
+	w := httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest("GET", "http://chat.example.com/auth/login/mock", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login should send the user to the issuer, got %d: %s", w.Code, w.Body)
+	}
+	loginURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loginURL.Query()
+	if loginURL.Path != "/authorize" || q.Get("client_id") != "chat" ||
+		q.Get("redirect_uri") != "http://chat.example.com/auth/callback/mock" {
+		t.Errorf("login wrongly redirected to %s", loginURL)
+	}
+	state := w.Result().Cookies()[0]
+	m.nonce = q.Get("nonce")
+
+	// a callback without the state of the login is refused
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://chat.example.com/auth/callback/mock?code=good&state=forged", nil)
+	req.AddCookie(state)
+	loginHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a forged state should be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://chat.example.com/auth/callback/mock?code=good&state="+q.Get("state"), nil)
+	req.AddCookie(state)
+	loginHandler(w, req)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/chat" {
+		t.Fatalf("the callback should sign in, got %d: %s", w.Code, w.Body)
+	}
+	var auth *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "auth" {
+			auth = cookie
+		}
+	}
+	if auth == nil {
+		t.Fatal("the callback should set the auth cookie")
+	}
+	req = httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(auth)
+	userData, err := authUserData(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same ID as a gomniauth login with the same email
+	if userData["userid"] != emailID("mat@example.com") || userData["name"] != "Mat Ryer" {
+		t.Errorf("the callback wrongly signed in %v", userData)
+	}
+}
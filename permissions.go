@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// role says what a user is allowed to do. Roles are ordered, every
+// role can do everything the roles below it can.
+type role int
+
+const (
+	roleGuest role = iota
+	roleMember
+	roleModerator
+	roleAdmin
+	roleOwner
+)
+
+var roleNames = []string{"guest", "member", "moderator", "admin", "owner"}
+
+func (r role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// parseRole turns a role name like "moderator" into a role.
+func parseRole(s string) (role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return role(i), nil
+		}
+	}
+	return roleGuest, fmt.Errorf("chat: unknown role %q", s)
+}
+
+// MarshalText stores roles by name so the roles file stays readable.
+func (r role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *role) UnmarshalText(text []byte) error {
+	parsed, err := parseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// permission is a single operation guarded by the permission layer.
+type permission int
+
+const (
+	// permPost allows sending messages to a room.
+	permPost permission = iota
+	// permModerate allows kicking and muting, and when held on the
+	// whole server banning.
+	permModerate
+	// permUploadAvatar allows uploading a profile picture.
+	permUploadAvatar
+	// permManageRoles allows assigning roles to other users.
+	permManageRoles
+	// permInvite allows handing out invite links to a room.
+	permInvite
+	// permManageMembers allows adding and removing room members.
+	permManageMembers
+	// permManageRoom allows changing the room settings.
+	permManageRoom
+)
+
+// minimumRole is the lowest role holding each permission.
+var minimumRole = map[permission]role{
+	permPost:          roleMember,
+	permModerate:      roleModerator,
+	permUploadAvatar:  roleMember,
+	permManageRoles:   roleAdmin,
+	permInvite:        roleMember,
+	permManageMembers: roleAdmin,
+	permManageRoom:    roleAdmin,
+}
+
+// can reports whether the role holds the permission.
+func (r role) can(p permission) bool {
+	return r >= minimumRole[p]
+}
+
+// roleAssignments is how roles are stored on disk. Global roles apply
+// to the whole server, room roles only to the named room.
+type roleAssignments struct {
+	Global map[string]role
+	Rooms  map[string]map[string]role
+}
+
+// roleStore holds the roles assigned to users, keyed by unique ID.
+type roleStore struct {
+	mu          sync.RWMutex
+	path        string
+	assigned    roleAssignments
+	defaultRole role
+}
+
+// loadRoleStore reads the roles stored at path. Users without any
+// assignment get defaultRole.
+func loadRoleStore(path string, defaultRole role) (*roleStore, error) {
+	s := &roleStore{path: path, defaultRole: defaultRole}
+	if err := loadJSON(path, &s.assigned); err != nil {
+		return nil, err
+	}
+	if s.assigned.Global == nil {
+		s.assigned.Global = make(map[string]role)
+	}
+	if s.assigned.Rooms == nil {
+		s.assigned.Rooms = make(map[string]map[string]role)
+	}
+	return s, nil
+}
+
+// Role gets the role of the user in the room, pass an empty room for
+// the server-wide role. Global admins and owners keep their role
+// everywhere, otherwise a room assignment wins over a global one.
+func (s *roleStore) Role(room, userID string) role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	global, hasGlobal := s.assigned.Global[userID]
+	if hasGlobal && global >= roleAdmin {
+		return global
+	}
+	if r, ok := s.assigned.Rooms[room][userID]; ok {
+		return r
+	}
+	if hasGlobal {
+		return global
+	}
+	return s.defaultRole
+}
+
+// Held lists every role the user holds, on the server and in each
+// room.
+func (s *roleStore) Held(userID string) []role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	global, ok := s.assigned.Global[userID]
+	if !ok {
+		global = s.defaultRole
+	}
+	held := []role{global}
+	for _, assigned := range s.assigned.Rooms {
+		if r, ok := assigned[userID]; ok {
+			held = append(held, r)
+		}
+	}
+	return held
+}
+
+// SetGlobal assigns the user a server-wide role and saves it.
+func (s *roleStore) SetGlobal(userID string, r role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assigned.Global[userID] = r
+	return saveJSON(s.path, s.assigned)
+}
+
+// SetRoom assigns the user a role in one room and saves it.
+func (s *roleStore) SetRoom(room, userID string, r role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.assigned.Rooms[room] == nil {
+		s.assigned.Rooms[room] = make(map[string]role)
+	}
+	s.assigned.Rooms[room][userID] = r
+	return saveJSON(s.path, s.assigned)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoleCan(t *testing.T) {
+
+	if roleGuest.can(permPost) {
+		t.Error("guests should not be able to post")
+	}
+	if !roleMember.can(permPost) {
+		t.Error("members should be able to post")
+	}
+	if roleMember.can(permModerate) {
+		t.Error("members should not be able to moderate")
+	}
+	if !roleOwner.can(permManageRoles) {
+		t.Error("owners should be able to manage roles")
+	}
+}
+
+func TestRoleStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "roles.json")
+
+	roles, err := loadRoleStore(filename, roleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := roles.Role("main", "abc"); r != roleMember {
+		t.Errorf("Role should return the default role, got %s", r)
+	}
+
+	roles.SetGlobal("abc", roleGuest)
+	roles.SetRoom("main", "abc", roleModerator)
+	roles.SetGlobal("admin", roleAdmin)
+	roles.SetRoom("main", "admin", roleGuest)
+
+	// reload to make sure the assignments were saved
+	roles, err = loadRoleStore(filename, roleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := roles.Role("main", "abc"); r != roleModerator {
+		t.Errorf("room role should win over the global role, got %s", r)
+	}
+	if r := roles.Role("other", "abc"); r != roleGuest {
+		t.Errorf("global role should apply in other rooms, got %s", r)
+	}
+	if r := roles.Role("main", "admin"); r != roleAdmin {
+		t.Errorf("global admins should keep their role in every room, got %s", r)
+	}
+}
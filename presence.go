@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"simple-go-chat/redis"
+	"simple-go-chat/trace"
+)
+
+// Presence keeps track of who is online in which room, across every
+// node sharing the same backend. Each node sends heartbeats, and the
+// users of a node that stopped sending them count as offline.
+type Presence interface {
+	// Join marks the user online in the room on this node.
+	Join(room, userID, name string) error
+	// Leave marks the user offline in the room on this node.
+	Leave(room, userID string) error
+	// Heartbeat tells the other nodes this node is still alive.
+	Heartbeat() error
+	// Online lists the users in the room on any live node.
+	Online(room string) ([]onlineUser, error)
+}
+
+// onlineUser is a user that is online in a room.
+type onlineUser struct {
+	UserID string
+	Name   string
+}
+
+// memoryPresence is a Presence for nodes within a single process,
+// all nodes made by the same newMemoryPresence share the data.
+type memoryPresence struct {
+	node   string
+	ttl    time.Duration
+	shared *memoryPresenceData
+}
+
+type memoryPresenceData struct {
+	mu sync.Mutex
+	// users maps room to node to unique ID to name
+	users      map[string]map[string]map[string]string
+	heartbeats map[string]time.Time
+}
+
+func newMemoryPresence(node string, ttl time.Duration) *memoryPresence {
+	return &memoryPresence{
+		node: node,
+		ttl:  ttl,
+		shared: &memoryPresenceData{
+			users:      make(map[string]map[string]map[string]string),
+			heartbeats: make(map[string]time.Time),
+		},
+	}
+}
+
+// onNode gets a Presence for another node sharing the same data.
+func (p *memoryPresence) onNode(node string) *memoryPresence {
+	return &memoryPresence{node: node, ttl: p.ttl, shared: p.shared}
+}
+
+func (p *memoryPresence) Join(room, userID, name string) error {
+	p.shared.mu.Lock()
+	defer p.shared.mu.Unlock()
+	nodes := p.shared.users[room]
+	if nodes == nil {
+		nodes = make(map[string]map[string]string)
+		p.shared.users[room] = nodes
+	}
+	if nodes[p.node] == nil {
+		nodes[p.node] = make(map[string]string)
+	}
+	nodes[p.node][userID] = name
+	return nil
+}
+
+func (p *memoryPresence) Leave(room, userID string) error {
+	p.shared.mu.Lock()
+	defer p.shared.mu.Unlock()
+	delete(p.shared.users[room][p.node], userID)
+	return nil
+}
+
+func (p *memoryPresence) Heartbeat() error {
+	p.shared.mu.Lock()
+	defer p.shared.mu.Unlock()
+	p.shared.heartbeats[p.node] = time.Now()
+	return nil
+}
+
+func (p *memoryPresence) Online(room string) ([]onlineUser, error) {
+	p.shared.mu.Lock()
+	defer p.shared.mu.Unlock()
+	users := make(map[string]string)
+	for node, nodeUsers := range p.shared.users[room] {
+		if time.Since(p.shared.heartbeats[node]) > p.ttl {
+			// the node crashed or lost its connection
+			delete(p.shared.users[room], node)
+			continue
+		}
+		for userID, name := range nodeUsers {
+			users[userID] = name
+		}
+	}
+	return sortedUsers(users), nil
+}
+
+// redisPresence is a Presence kept in Redis. Every room is a hash
+// from "node|userid" to the user's name, and every live node has a
+// key that expires unless the node keeps sending heartbeats.
+type redisPresence struct {
+	node   string
+	ttl    time.Duration
+	client *redis.Client
+}
+
+func newRedisPresence(addr, node string, ttl time.Duration) *redisPresence {
+	return &redisPresence{node: node, ttl: ttl, client: redis.NewClient(addr)}
+}
+
+func presenceKey(room string) string  { return "chat:presence:" + room }
+func heartbeatKey(node string) string { return "chat:node:" + node }
+
+func (p *redisPresence) Join(room, userID, name string) error {
+	_, err := p.client.Do("HSET", presenceKey(room), p.node+"|"+userID, name)
+	return err
+}
+
+func (p *redisPresence) Leave(room, userID string) error {
+	_, err := p.client.Do("HDEL", presenceKey(room), p.node+"|"+userID)
+	return err
+}
+
+func (p *redisPresence) Heartbeat() error {
+	ms := strconv.FormatInt(int64(p.ttl/time.Millisecond), 10)
+	_, err := p.client.Do("SET", heartbeatKey(p.node), "1", "PX", ms)
+	return err
+}
+
+func (p *redisPresence) Online(room string) ([]onlineUser, error) {
+	reply, err := p.client.Do("HGETALL", presenceKey(room))
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]interface{})
+
+	alive := make(map[string]bool)
+	users := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		field, _ := fields[i].([]byte)
+		name, _ := fields[i+1].([]byte)
+		parts := strings.SplitN(string(field), "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		node, userID := parts[0], parts[1]
+
+		live, checked := alive[node]
+		if !checked {
+			exists, err := p.client.Do("EXISTS", heartbeatKey(node))
+			if err != nil {
+				return nil, err
+			}
+			live = exists == int64(1)
+			alive[node] = live
+		}
+		if !live {
+			// the node crashed or lost its connection, tidy up
+			p.client.Do("HDEL", presenceKey(room), string(field))
+			continue
+		}
+		users[userID] = string(name)
+	}
+	return sortedUsers(users), nil
+}
+
+// sortedUsers turns a map of unique ID to name into a list sorted by
+// name.
+func sortedUsers(users map[string]string) []onlineUser {
+	list := make([]onlineUser, 0, len(users))
+	for userID, name := range users {
+		list = append(list, onlineUser{UserID: userID, Name: name})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].UserID < list[j].UserID
+	})
+	return list
+}
+
+// asyncPresence writes joins and leaves from a goroutine of its own,
+// so rooms never wait on the backend. Only the latest update of each
+// user in each room waits to be written, so nothing is ever dropped
+// and the backlog cannot grow past the users online. The rest goes
+// straight to the Presence it wraps.
+type asyncPresence struct {
+	Presence
+	tracer trace.Tracer
+
+	mu sync.Mutex
+	// pending holds the update waiting for each room and user, order
+	// the keys in the order they started waiting.
+	pending map[presenceUser]presenceUpdate
+	order   []presenceUser
+	// wake tells the writer there is something pending.
+	wake chan struct{}
+}
+
+// presenceUser is a user in a room.
+type presenceUser struct {
+	room, userID string
+}
+
+// presenceUpdate is a join or a leave waiting to be written.
+type presenceUpdate struct {
+	name  string
+	leave bool
+}
+
+func newAsyncPresence(p Presence, tracer trace.Tracer) *asyncPresence {
+	a := &asyncPresence{
+		Presence: p,
+		tracer:   tracer,
+		pending:  make(map[presenceUser]presenceUpdate),
+		wake:     make(chan struct{}, 1),
+	}
+	go a.write()
+	return a
+}
+
+func (a *asyncPresence) Join(room, userID, name string) error {
+	a.queue(presenceUser{room, userID}, presenceUpdate{name: name})
+	return nil
+}
+
+func (a *asyncPresence) Leave(room, userID string) error {
+	a.queue(presenceUser{room, userID}, presenceUpdate{leave: true})
+	return nil
+}
+
+// queue hands the update to the writer, replacing the one still
+// waiting for the same room and user.
+func (a *asyncPresence) queue(key presenceUser, u presenceUpdate) {
+	a.mu.Lock()
+	if _, waiting := a.pending[key]; !waiting {
+		a.order = append(a.order, key)
+	}
+	a.pending[key] = u
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+		// the writer has been told already
+	}
+}
+
+// next takes the update that has waited longest.
+func (a *asyncPresence) next() (presenceUser, presenceUpdate, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.order) == 0 {
+		return presenceUser{}, presenceUpdate{}, false
+	}
+	key := a.order[0]
+	a.order = a.order[1:]
+	u := a.pending[key]
+	delete(a.pending, key)
+	return key, u, true
+}
+
+// write applies the pending updates until the program ends.
+func (a *asyncPresence) write() {
+	for range a.wake {
+		for {
+			key, u, ok := a.next()
+			if !ok {
+				break
+			}
+			var err error
+			if u.leave {
+				err = a.Presence.Leave(key.room, key.userID)
+			} else {
+				err = a.Presence.Join(key.room, key.userID, u.name)
+			}
+			if err != nil {
+				a.tracer.Trace("Presence update failed: ", err)
+			}
+		}
+	}
+}
+
+// heartbeat keeps this node marked alive until the program ends.
+func heartbeat(p Presence, every time.Duration, tracer trace.Tracer) {
+	for {
+		if err := p.Heartbeat(); err != nil {
+			tracer.Trace("Presence heartbeat failed: ", err)
+		}
+		time.Sleep(every)
+	}
+}
+
+// trackJoin marks the user online once their first client on this
+// node has joined the room.
+func (r *room) trackJoin(c *client) {
+	if r.presence == nil || r.userClients(c.userID()) != 1 {
+		return
+	}
+	if err := r.presence.Join(r.name, c.userID(), c.name()); err != nil {
+		r.tracer.Trace("Presence join failed: ", err)
+	}
+}
+
+// trackLeave marks the user offline once their last client on this
+// node has left the room.
+func (r *room) trackLeave(c *client) {
+	if r.presence == nil || r.userClients(c.userID()) != 0 {
+		return
+	}
+	if err := r.presence.Leave(r.name, c.userID()); err != nil {
+		r.tracer.Trace("Presence leave failed: ", err)
+	}
+}
+
+// userClients counts the clients the user has in the room.
+func (r *room) userClients(userID string) int {
+	n := 0
+	for client := range r.clients {
+		if client.userID() == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// presenceHandler lists who is online in a room on any node.
+// format: GET /rooms/presence?room={room}
+func presenceHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	name := req.FormValue("room")
+	cfg, ok := rooms.store.Room(name)
+	if !ok || cfg.Visibility != visibilityPublic && !cfg.Members[userID] && roles.Role(name, userID) < roleAdmin {
+		http.Error(w, ErrNoRoom.Error(), http.StatusNotFound)
+		return
+	}
+
+	online, err := rooms.presence.Online(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(online)
+}
+
+// defaultNodeID names the node after the host and process.
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
+	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"simple-go-chat/trace"
+)
+
+// testPresence checks presence across two nodes, one of which stops
+// sending heartbeats.
+func testPresence(t *testing.T, first, second Presence, ttl time.Duration) {
+
+	first.Heartbeat()
+	second.Heartbeat()
+	first.Join("main", "abc", "Mat")
+	second.Join("main", "def", "Tyler")
+	second.Join("other", "ghi", "Someone")
+
+	online, err := first.Online("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(online) != 2 || online[0].Name != "Mat" || online[1].Name != "Tyler" {
+		t.Errorf("Online should list users from both nodes, got %v", online)
+	}
+
+	first.Leave("main", "abc")
+	online, _ = second.Online("main")
+	if len(online) != 1 || online[0].UserID != "def" {
+		t.Errorf("Online should not list users that left, got %v", online)
+	}
+
+	// the second node crashes and stops sending heartbeats
+	time.Sleep(ttl + 50*time.Millisecond)
+	first.Heartbeat()
+	online, _ = first.Online("main")
+	if len(online) != 0 {
+		t.Errorf("users of a dead node should be offline, got %v", online)
+	}
+}
+
+func TestMemoryPresence(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	p := newMemoryPresence("one", ttl)
+	testPresence(t, p, p.onNode("two"), ttl)
+}
+
+// TestRedisPresence runs against the Redis server given by REDIS_ADDR,
+// or else against fakeRedis.
+func TestRedisPresence(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = newFakeRedis(t).addr()
+	}
+	ttl := 200 * time.Millisecond
+	testPresence(t, newRedisPresence(addr, "one", ttl), newRedisPresence(addr, "two", ttl), ttl)
+}
+
+// slowPresence is a Presence whose backend hangs until release is
+// closed.
+type slowPresence struct {
+	*memoryPresence
+	release chan struct{}
+}
+
+func (p slowPresence) Join(room, userID, name string) error {
+	<-p.release
+	return p.memoryPresence.Join(room, userID, name)
+}
+
+func TestAsyncPresence(t *testing.T) {
+
+	slow := slowPresence{newMemoryPresence("one", time.Minute), make(chan struct{})}
+	slow.Heartbeat()
+	p := newAsyncPresence(slow, trace.Off())
+
+	// far more updates than a fixed queue would hold, while the
+	// backend is stuck, with half of the users leaving again
+	const users = 3000
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < users; i++ {
+			p.Join("main", fmt.Sprint("user", i), "User")
+		}
+		for i := 0; i < users; i += 2 {
+			p.Leave("main", fmt.Sprint("user", i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("joining should not wait for the backend")
+	}
+
+	close(slow.release)
+	timeout := time.After(2 * time.Second)
+	for {
+		online, _ := p.Online("main")
+		left := 0
+		for _, u := range online {
+			var n int
+			fmt.Sscanf(u.UserID, "user%d", &n)
+			if n%2 == 0 {
+				left++
+			}
+		}
+		if len(online) == users/2 && left == 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("every update should be written, %d online of whom %d left", len(online), left)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
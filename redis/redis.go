@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply sent by the server, such as
+// "ERR unknown command".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrProtocol is returned when the server sends something that is not
+// a valid RESP reply.
+var ErrProtocol = errors.New("redis: protocol error")
+
+// Conn is a single connection to a server speaking the Redis
+// protocol (RESP). A Conn is not safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Dial connects to the server at addr, e.g. "localhost:6379".
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn wraps an existing network connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Send writes a command to the server without waiting for the reply.
+func (c *Conn) Send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.w.Flush()
+}
+
+// Receive reads the next reply. Replies come back as string for
+// simple strings, int64 for integers, []byte for bulk strings (nil if
+// missing), []interface{} for arrays and Error for error replies.
+func (c *Conn) Receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return Error(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.Receive(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, ErrProtocol
+}
+
+// Do sends a command and reads its reply. Error replies are returned
+// as the error.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// Client is a connection to a server that is safe for concurrent use
+// and reconnects after a failed command.
+type Client struct {
+	addr string
+	mu   sync.Mutex
+	conn *Conn
+}
+
+// NewClient makes a Client for the server at addr. No connection is
+// made until the first command.
+func NewClient(addr string) *Client {
+	return &Client{addr: addr}
+}
+
+// Do sends a command and reads its reply, like Conn.Do.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := Dial(c.addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	reply, err := c.conn.Do(args...)
+	if _, isReply := err.(Error); err != nil && !isReply {
+		// the connection is in an unknown state, start afresh
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// a stand-in server that checks the command and sends back
+	// one reply of every kind
+	go func() {
+		r := bufio.NewReader(server)
+		want := "*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != want {
+			server.Write([]byte("-ERR bad command\r\n"))
+			return
+		}
+		server.Write([]byte("*4\r\n+OK\r\n:42\r\n$2\r\nhi\r\n$-1\r\n"))
+	}()
+
+	reply, err := NewConn(client).Do("ECHO", "hi")
+	if err != nil {
+		t.Fatalf("Do should not return an error: %s", err)
+	}
+	want := []interface{}{"OK", int64(42), []byte("hi"), nil}
+	if !reflect.DeepEqual(reply, want) {
+		t.Errorf("Do wrongly returned %#v", reply)
+	}
+}
+
+func TestDoError(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		server.Write([]byte("-ERR unknown command\r\n"))
+	}()
+
+	_, err := NewConn(client).Do("NOPE")
+	if err != Error("ERR unknown command") {
+		t.Errorf("Do should return the error reply, got %v", err)
+	}
+}
@@ -1,185 +1,456 @@
-package main
-
-import {
-	"simple-go-chat/trace"
-}
-/*
-	We need a way for clients to join and leave rooms in order to ensure that
-	the c.room.forward <- msg code in the preceding section actually forwards
-	the message to all the clients. To ensure that we are not trying to access
-	the same data at the same time, a sensible approach is to use two channels:
-	one that will add a client to the room and another that will remove it
-*/
-
-type room struct {
-	// forward is a channel that holds incoming messages
-	// that should be forwarded to the other clients.
-	// we will use to send the incoming messages to all other clients
-	forward chan *message
-
-	// join is a channel for clients wishing to join the room.
-	join chan *client
-
-	// leave is a channel for clients wishing to leave the room.
-	leave chan *client
-
-	// clients holds all current clients in this room.
-	clients map[*client]bool
-
-	// tracer will receive trace information of activity
-	// in the room.
-	tracer trace.Tracer
-
-	// avatar is how avatar information will be obtained.
-	// avatar Avatar
-}
-
-/*
-	Now we get to use an extremely powerful feature of Go's concurrency offerings the
-	select statement. We can use select statements whenever we need to synchronize or
-	modify shared memory, or take different actions depending on the various activities
-	within our channels.
-*/
-func (r *room) run() {
-
-	/*
-		The top for loop indicates that this method will run forever, until the program
-		is terminated. This might seem like a mistake, but remember, if we run this code
-		as a goroutine, it will run in the background, which won't block the rest of our
-		application
-	*/
-	for {
-		select {
-
-		/*
-			If we receive a message on the join channel, we simply update the r.clients map to
-			keep a reference of the client that has joined the room. Notice that we are setting
-			the value to true. We are using the map more like a slice, but do not have to worry
-			about shrinking the slice as clients come and go through time setting the value to
-			true is just a handy, low memory way of storing the reference.
-		*/
-		case client := <-r.join:
-			// joining
-			r.clients[client] = true
-
-			r.tracer.Trace("New client joined")
-		/*
-			If we receive a message on the leave channel, we simply delete the client type from
-			the map, and close its send channel
-		*/
-		case client := <-r.leave:
-			// leaving
-			delete(r.clients, client)
-			close(client.send)
-
-			r.tracer.Trace("Client left")
-
-		/*
-			If we receive a message on the forward channel, we iterate over all the clients and
-			add  the message to each client's send channel. Then, the write method of our client
-			type will pick it up and send it down the socket to the browser.
-		*/
-		case msg := <-r.forward:
-
-			r.tracer.Trace("Message received: ", msg.Message)
-
-			// forward message to all clients
-			for client := range r.clients {
-				client.send <- msg
-
-				r.tracer.Trace(" -- sent to client")
-			}
-		}
-	}
-}
-
-/*
-	Now we are going to turn our room type into an http.Handler type like we did with the
-	template handler earlier. As you will recall, to do this, we must simply add a method
-	called ServeHTTP with the appropriate signature.
-*/
-const (
-	socketBufferSize  = 1024
-	messageBufferSize = 256
-)
-
-/*
-	If you accessed the chat endpoint in a web browser, you would likely crash the program
-	and see an error like ServeHTTPwebsocket: version != 13. This is because it is intended
-	to be accessed via a web socket rather than a web browser.
-*/
-var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize}
-
-func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-
-	/*
-		In order to use web sockets, we must upgrade the HTTP connection using the websocket.
-		Upgrader type, which is reusable so we need only create one. Then, when a request comes
-		in via the ServeHTTP method, we get the socket by calling the upgrader.Upgrade method.
-	*/
-	socket, err := upgrader.Upgrade(w, req, nil)
-
-	if err != nil {
-		log.Fatal("ServeHTTP:", err)
-		return
-	}
-
-	/*
-		Melakukan pengecekan terkait user information
-		dari Cookies
-	*/
-	authCookie, err := req.Cookie("auth")
-	
-	if err != nil {
-		log.Fatal("Failed to get auth cookie:", err)
-		return
-	}
-
-	/*
-		All being well, we then create our client and pass it into the join channel for the current
-		room. We also defer the leaving operation for when the client is finished, which will ensure
-		everything is tidied up after a user goes away
-	*/
-	client := &client{
-		socket: socket,
-		send:   make(chan *message, messageBufferSize),
-		room:   r,
-		userData: objx.MustFromBase64(authCookie.Value),
-	}
-	r.join <- client
-	defer func() { r.leave <- client }()
-
-	// Go Routine sendiri, jalan di belakang - Asychoronous
-	go client.write()
-
-	client.read()
-}
-
-// newRoom makes a new room.
-// func newRoom() *room {
-// 	return &room{
-// 		forward: make(chan *message),
-// 		join:    make(chan *client),
-// 		leave:   make(chan *client),
-// 		clients: make(map[*client]bool),
-// 		tracer: trace.Off(),
-// 	}
-// }
-
-/*
-	newRoom makes a new room that is ready to go.
-
-	Room untuk menciptakan room dengan image avatar
-	tertentu.
-*/
-func newRoom(avatar Avatar) *room {
-
-	return &room{
-		forward: make(chan *message),
-		join: make(chan *client),
-		leave: make(chan *client),
-		clients: make(map[*client]bool),
-		tracer: trace.Off(),
-		// avatar: avatar,
-	}
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"simple-go-chat/trace"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	We need a way for clients to join and leave rooms in order to ensure that
+	the c.room.forward <- msg code in the preceding section actually forwards
+	the message to all the clients. To ensure that we are not trying to access
+	the same data at the same time, a sensible approach is to use two channels:
+	one that will add a client to the room and another that will remove it
+*/
+
+type room struct {
+	// occupancy and waitingCount are kept up to date for readers
+	// outside the room goroutine, and are only used atomically.
+	occupancy    int64
+	waitingCount int64
+
+	// name identifies the room, e.g. for per-room roles.
+	name string
+
+	// forward is a channel that holds incoming messages
+	// that should be forwarded to the other clients.
+	// we will use to send the incoming messages to all other clients
+	forward chan *message
+
+	// join is a channel for clients wishing to join the room.
+	join chan *client
+
+	// leave is a channel for clients wishing to leave the room.
+	leave chan *client
+
+	// clients holds all current clients in this room.
+	clients map[*client]bool
+
+	// tracer will receive trace information of activity
+	// in the room.
+	tracer trace.Tracer
+
+	// avatar is how avatar information will be obtained.
+	// avatar Avatar
+
+	// commands is a channel for slash commands typed by clients.
+	commands chan *command
+
+	// bans is the durable list of banned users.
+	bans *banList
+
+	// muted holds the time until which a user is muted, keyed by
+	// unique ID.
+	muted map[string]time.Time
+
+	// roles decides what each user may do in this room.
+	roles *roleStore
+
+	// store holds the room's visibility and member list.
+	store *roomStore
+
+	// settings are the current room settings, changed through
+	// settingsUpdates or the /topic and /set commands.
+	settings        roomSettings
+	settingsUpdates chan settingsUpdate
+
+	// lastPosted holds when each user last posted, for slow mode.
+	lastPosted map[string]time.Time
+
+	// waiting holds the read-only clients that joined while the room
+	// was full, in the order they joined.
+	waiting []*client
+
+	// registry is the registry that started this room.
+	registry *roomRegistry
+
+	// idleTimeout is how long the room keeps running without any
+	// clients, zero keeps it running forever.
+	idleTimeout time.Duration
+	idle        *time.Timer
+
+	// done is closed when the room has stopped.
+	done chan struct{}
+
+	// broker shares the room's messages with the other nodes, and
+	// incoming delivers everything published to the room, including
+	// the messages this room published itself.
+	broker      Broker
+	incoming    <-chan *message
+	unsubscribe func()
+	// retrySubscribe fires when it is time to subscribe again after
+	// losing the broker, resubscribeDelay is how long it waited.
+	retrySubscribe   <-chan time.Time
+	resubscribeDelay time.Duration
+
+	// presence tracks who is online across all nodes.
+	presence Presence
+
+	// fanout delivers messages to the clients, it is the only one
+	// sending to or closing their send channels once they joined.
+	fanout *fanout
+
+	// audit receives a line for every moderation action.
+	audit trace.Tracer
+
+	// history keeps the latest messages for the REST API.
+	history *messageHistory
+
+	// revoke takes the IDs of ended sessions, whose clients are
+	// disconnected.
+	revoke chan string
+
+	// removed takes the unique IDs of users removed from the room's
+	// members, whose clients are disconnected.
+	removed chan string
+}
+
+/*
+	Now we get to use an extremely powerful feature of Go's concurrency offerings the
+	select statement. We can use select statements whenever we need to synchronize or
+	modify shared memory, or take different actions depending on the various activities
+	within our channels.
+*/
+func (r *room) run() {
+
+	/*
+		The top for loop indicates that this method will run forever, until the program
+		is terminated. This might seem like a mistake, but remember, if we run this code
+		as a goroutine, it will run in the background, which won't block the rest of our
+		application
+
+		Kecuali room sudah idle (tidak ada client) selama idleTimeout, maka goroutine
+		berhenti dan room akan dijalankan lagi oleh registry saat ada yang join.
+	*/
+	r.fanout.start()
+	if r.broker != nil {
+		// subscribing can take a while when the broker is slow or
+		// down, so it is done here instead of by the registry
+		r.resubscribe()
+	}
+
+	for {
+		idle := r.resetIdle()
+
+		select {
+
+		/*
+			If we receive a message on the join channel, we simply update the r.clients map to
+			keep a reference of the client that has joined the room. Notice that we are setting
+			the value to true. We are using the map more like a slice, but do not have to worry
+			about shrinking the slice as clients come and go through time setting the value to
+			true is just a handy, low memory way of storing the reference.
+		*/
+		case client := <-r.join:
+			// joining
+			if !r.admit(client) {
+				r.tracer.Trace("Client turned away, room is full")
+				continue
+			}
+			r.clients[client] = true
+			r.fanout.add(client)
+			r.countOccupancy()
+			r.trackJoin(client)
+
+			r.tracer.Trace("New client joined")
+		/*
+			If we receive a message on the leave channel, we simply delete the client type from
+			the map, and close its send channel
+		*/
+		case client := <-r.leave:
+			// leaving - a kicked client has already been removed
+			if _, ok := r.clients[client]; ok {
+				delete(r.clients, client)
+				r.fanout.remove(client)
+				r.trackLeave(client)
+			}
+			r.forgetWaiting(client)
+			r.admitWaiting()
+			r.countOccupancy()
+
+			r.tracer.Trace("Client left")
+
+		/*
+			If we receive a message on the forward channel, we iterate over all the clients and
+			add  the message to each client's send channel. Then, the write method of our client
+			type will pick it up and send it down the socket to the browser.
+		*/
+		case msg := <-r.forward:
+
+			r.tracer.Trace("Message received: ", msg.Message)
+
+			if reason := r.refusePost(msg); reason != "" {
+				r.notify(msg.UserID, reason)
+				msg.answer(errors.New(reason))
+				continue
+			}
+
+			r.publish(msg)
+			msg.answer(nil)
+
+		case msg, ok := <-r.incoming:
+			if !ok {
+				r.resubscribe()
+				continue
+			}
+			r.receive(msg)
+
+		case <-r.retrySubscribe:
+			r.resubscribe()
+
+		case cmd := <-r.commands:
+			r.handleCommand(cmd)
+
+		case update := <-r.settingsUpdates:
+			settings, err := r.updateSettings(update)
+			if update.done != nil {
+				update.done <- settingsResult{settings, err}
+			}
+
+		case id := <-r.revoke:
+			r.dropSession(id)
+
+		case userID := <-r.removed:
+			r.dropMember(userID)
+
+		case <-idle:
+			r.idle = nil
+			if r.registry.release(r) {
+				r.unsubscribe()
+				r.fanout.stop()
+				r.tracer.Trace("Room stopped after being idle")
+				return
+			}
+		}
+	}
+}
+
+// refusePost gives the reason the message may not be posted, or ""
+// if it may.
+func (r *room) refusePost(msg *message) string {
+	if msg.from != nil && msg.from.readOnly {
+		return "The room is full, you cannot post until somebody leaves"
+	}
+	if msg.from != nil && !hasScope(msg.from.userData, scopeWrite) {
+		return errTokenScope.Error()
+	}
+	if !r.can(msg.UserID, permPost) {
+		return "You have read-only access to this room"
+	}
+	if r.isMuted(msg.UserID) {
+		return "You are muted and cannot send messages"
+	}
+	if wait := r.slowModeWait(msg.UserID); wait > 0 {
+		return fmt.Sprintf("Slow mode is on, you can send another message in %s", wait)
+	}
+	return ""
+}
+
+// can reports whether the user holds the permission in this room.
+func (r *room) can(userID string, p permission) bool {
+	return r.roles.Role(r.name, userID).can(p)
+}
+
+// authorize checks that the request comes from a signed in user who
+// may join the room, writing an error response if not. It is used by
+// every transport before joining a client.
+func (r *room) authorize(w http.ResponseWriter, req *http.Request) (map[string]interface{}, bool) {
+	userData, err := requestUserData(req)
+	if err == ErrInvalidCookie {
+		relogin(w)
+		return nil, false
+	}
+	if err == ErrInvalidToken {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "You must be signed in", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !hasScope(userData, scopeRead) {
+		http.Error(w, errTokenScope.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	userID, _ := userData["userid"].(string)
+	if err := r.checkAccess(userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return userData, true
+}
+
+var (
+	errBanned    = errors.New("You are banned from this room")
+	errNotMember = errors.New("You are not a member of this room")
+)
+
+// checkAccess checks that the user may take part in the room.
+func (r *room) checkAccess(userID string) error {
+	if r.bans.IsBanned(userID) {
+		return errBanned
+	}
+	if !r.canJoin(userID) {
+		return errNotMember
+	}
+	return nil
+}
+
+// canJoin reports whether the user may join the room. Public rooms
+// are open to everyone, other rooms to their members and admins.
+func (r *room) canJoin(userID string) bool {
+	cfg, ok := r.store.Room(r.name)
+	if !ok {
+		return false
+	}
+	if cfg.Visibility == visibilityPublic {
+		return true
+	}
+	return cfg.Members[userID] || r.roles.Role(r.name, userID) >= roleAdmin
+}
+
+// broadcast forwards the message to all clients in the room.
+func (r *room) broadcast(msg *message) {
+	r.fanout.broadcast(msg)
+	r.remember(msg)
+
+	r.tracer.Trace(" -- sent to ", len(r.clients), " clients")
+}
+
+/*
+	Now we are going to turn our room type into an http.Handler type like we did with the
+	template handler earlier. As you will recall, to do this, we must simply add a method
+	called ServeHTTP with the appropriate signature.
+*/
+const (
+	socketBufferSize  = 1024
+	messageBufferSize = 256
+	// maxFrameSize is the largest frame a client may send, bigger
+	// frames close the connection.
+	maxFrameSize = 64 * 1024
+)
+
+/*
+	If you accessed the chat endpoint in a web browser, you would likely crash the program
+	and see an error like ServeHTTPwebsocket: version != 13. This is because it is intended
+	to be accessed via a web socket rather than a web browser.
+*/
+var upgrader = &websocket.Upgrader{
+	ReadBufferSize:  socketBufferSize,
+	WriteBufferSize: socketBufferSize,
+	Subprotocols:    subprotocols,
+	CheckOrigin:     checkOrigin,
+}
+
+func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	/*
+		Melakukan pengecekan terkait user information
+		dari Cookies, sebelum koneksi di-upgrade supaya user
+		yang di-ban bisa ditolak dengan HTTP error biasa
+	*/
+	userData, ok := r.authorize(w, req)
+	if !ok {
+		return
+	}
+	if err := checkTokenSubprotocol(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	/*
+		In order to use web sockets, we must upgrade the HTTP connection using the websocket.
+		Upgrader type, which is reusable so we need only create one. Then, when a request comes
+		in via the ServeHTTP method, we get the socket by calling the upgrader.Upgrade method.
+	*/
+	socket, err := upgrader.Upgrade(w, req, nil)
+
+	if err != nil {
+		// Upgrade has already answered the request
+		log.Println("ServeHTTP:", err)
+		return
+	}
+	socket.SetReadLimit(maxFrameSize)
+
+	/*
+		All being well, we then create our client and pass it into the join channel for the current
+		room. We also defer the leaving operation for when the client is finished, which will ensure
+		everything is tidied up after a user goes away
+	*/
+	client := &client{
+		socket: socket,
+		send:   make(chan *message, messageBufferSize),
+		room:   r,
+		userData: userData,
+		format:   formatFor(socket.Subprotocol()),
+	}
+	client.startCompression(req)
+	r, err = r.enter(client)
+	if err != nil {
+		socket.Close()
+		return
+	}
+	defer func() { r.exit(client) }()
+
+	// Go Routine sendiri, jalan di belakang - Asychoronous
+	go client.write()
+
+	client.read()
+}
+
+// newRoom makes a new room.
+// func newRoom() *room {
+// 	return &room{
+// 		forward: make(chan *message),
+// 		join:    make(chan *client),
+// 		leave:   make(chan *client),
+// 		clients: make(map[*client]bool),
+// 		tracer: trace.Off(),
+// 	}
+// }
+
+/*
+	newRoom makes a new room that is ready to go.
+
+	Room untuk menciptakan room dengan image avatar
+	tertentu.
+*/
+func newRoom(name string, avatar Avatar) *room {
+
+	return &room{
+		name: name,
+		forward: make(chan *message),
+		join: make(chan *client),
+		leave: make(chan *client),
+		clients: make(map[*client]bool),
+		tracer: trace.Off(),
+		// avatar: avatar,
+		commands:        make(chan *command),
+		settingsUpdates: make(chan settingsUpdate),
+		revoke:          make(chan string),
+		removed:         make(chan string),
+		muted:           make(map[string]time.Time),
+		lastPosted:      make(map[string]time.Time),
+		done:            make(chan struct{}),
+		unsubscribe:     func() {},
+		fanout:          newFanout(1),
+		audit:           trace.Off(),
+	}
+}
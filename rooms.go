@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"simple-go-chat/trace"
+
+	"github.com/gorilla/websocket"
+)
+
+// visibility controls who can find and join a room.
+type visibility string
+
+const (
+	// visibilityPublic rooms can be joined by anyone signed in.
+	visibilityPublic visibility = "public"
+	// visibilityPrivate rooms are only open to members added by a
+	// room admin.
+	visibilityPrivate visibility = "private"
+	// visibilityInvite rooms are open to members, and any member
+	// can hand out invite links.
+	visibilityInvite visibility = "invite"
+)
+
+// mainRoom is the room every server starts with.
+const mainRoom = "main"
+
+var validRoomName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var (
+	// ErrNoRoom is returned when a room does not exist.
+	ErrNoRoom = errors.New("chat: No such room.")
+	// ErrRoomExists is returned when creating a room that already exists.
+	ErrRoomExists = errors.New("chat: Room already exists.")
+	// ErrInvalidInvite is returned for unknown, expired or used up invites.
+	ErrInvalidInvite = errors.New("chat: Invite is invalid or has expired.")
+)
+
+// roomConfig is the stored description of a room.
+type roomConfig struct {
+	Name       string
+	Visibility visibility
+	Owner      string
+	Created    time.Time
+	// Members holds the unique IDs of the room members.
+	Members  map[string]bool
+	Settings roomSettings
+}
+
+// invite lets whoever holds the link become a member of a room.
+type invite struct {
+	Code      string
+	Room      string
+	CreatedBy string
+	// Expires is the zero time for invites that never expire.
+	Expires time.Time
+	// MaxUses is zero for invites that can be used any number of times.
+	MaxUses int
+	Uses    int
+}
+
+// roomStore is the durable list of rooms, their members and the
+// outstanding invites.
+type roomStore struct {
+	mu   sync.RWMutex
+	path string
+	data struct {
+		Rooms   map[string]*roomConfig
+		Invites map[string]*invite
+	}
+}
+
+// loadRoomStore reads the rooms stored at path.
+func loadRoomStore(path string) (*roomStore, error) {
+	s := &roomStore{path: path}
+	if err := loadJSON(path, &s.data); err != nil {
+		return nil, err
+	}
+	if s.data.Rooms == nil {
+		s.data.Rooms = make(map[string]*roomConfig)
+	}
+	if s.data.Invites == nil {
+		s.data.Invites = make(map[string]*invite)
+	}
+	return s, nil
+}
+
+// Room gets a copy of the stored room config.
+func (s *roomStore) Room(name string) (roomConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg, ok := s.data.Rooms[name]
+	if !ok {
+		return roomConfig{}, false
+	}
+	c := *cfg
+	c.Members = make(map[string]bool, len(cfg.Members))
+	for userID := range cfg.Members {
+		c.Members[userID] = true
+	}
+	return c, true
+}
+
+// Rooms gets copies of all the stored room configs, sorted by name.
+func (s *roomStore) Rooms() []roomConfig {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.data.Rooms))
+	for name := range s.data.Rooms {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(names)
+	list := make([]roomConfig, 0, len(names))
+	for _, name := range names {
+		if cfg, ok := s.Room(name); ok {
+			list = append(list, cfg)
+		}
+	}
+	return list
+}
+
+// visibleTo reports whether the user can see the room, public rooms
+// are visible to everyone, other rooms to their members and admins.
+func (cfg roomConfig) visibleTo(userID string) bool {
+	return cfg.Visibility == visibilityPublic || cfg.Members[userID] || roles.Role(cfg.Name, userID) >= roleAdmin
+}
+
+// Create adds a new room and saves it.
+func (s *roomStore) Create(cfg roomConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Rooms[cfg.Name]; ok {
+		return ErrRoomExists
+	}
+	if cfg.Members == nil {
+		cfg.Members = make(map[string]bool)
+	}
+	s.data.Rooms[cfg.Name] = &cfg
+	return saveJSON(s.path, s.data)
+}
+
+// IsMember reports whether the user is a member of the room.
+func (s *roomStore) IsMember(name, userID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg, ok := s.data.Rooms[name]
+	return ok && cfg.Members[userID]
+}
+
+// SetMember adds the user to, or removes the user from, the room.
+func (s *roomStore) SetMember(name, userID string, member bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, ok := s.data.Rooms[name]
+	if !ok {
+		return ErrNoRoom
+	}
+	if member {
+		cfg.Members[userID] = true
+	} else {
+		delete(cfg.Members, userID)
+	}
+	return saveJSON(s.path, s.data)
+}
+
+// CreateInvite makes a new invite for the room.
+func (s *roomStore) CreateInvite(name, createdBy string, ttl time.Duration, maxUses int) (*invite, error) {
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Rooms[name]; !ok {
+		return nil, ErrNoRoom
+	}
+	inv := &invite{
+		Code:      hex.EncodeToString(code),
+		Room:      name,
+		CreatedBy: createdBy,
+		MaxUses:   maxUses,
+	}
+	if ttl > 0 {
+		inv.Expires = time.Now().Add(ttl)
+	}
+	s.data.Invites[inv.Code] = inv
+	return inv, saveJSON(s.path, s.data)
+}
+
+// RedeemInvite makes the user a member of the invite's room and
+// returns the room name.
+func (s *roomStore) RedeemInvite(code, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.data.Invites[code]
+	if !ok {
+		return "", ErrInvalidInvite
+	}
+	if !inv.Expires.IsZero() && time.Now().After(inv.Expires) {
+		delete(s.data.Invites, code)
+		saveJSON(s.path, s.data)
+		return "", ErrInvalidInvite
+	}
+	cfg, ok := s.data.Rooms[inv.Room]
+	if !ok {
+		return "", ErrNoRoom
+	}
+	if !cfg.Members[userID] {
+		cfg.Members[userID] = true
+		inv.Uses++
+		if inv.MaxUses > 0 && inv.Uses >= inv.MaxUses {
+			delete(s.data.Invites, code)
+		}
+	}
+	return inv.Room, saveJSON(s.path, s.data)
+}
+
+// roomRegistry keeps the running rooms, starting them on first use.
+type roomRegistry struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	store *roomStore
+	// stopped holds the state of rooms that stopped for being idle.
+	stopped map[string]roomState
+
+	// everything a new room is set up with
+	bans        *banList
+	roles       *roleStore
+	audit       trace.Tracer
+	tracer      trace.Tracer
+	idleTimeout time.Duration
+	broker      Broker
+	presence    Presence
+	shards      int
+	history     *messageHistory
+}
+
+// newRoomRegistry makes a registry for the rooms in store.
+func newRoomRegistry(store *roomStore) *roomRegistry {
+	return &roomRegistry{
+		rooms:   make(map[string]*room),
+		stopped: make(map[string]roomState),
+		store:   store,
+		audit:   trace.Off(),
+		tracer:  trace.Off(),
+		history: newMessageHistory(defaultHistoryLimit),
+	}
+}
+
+// get gets the named room, starting it if it is not running yet.
+func (reg *roomRegistry) get(name string) (*room, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if r, ok := reg.rooms[name]; ok {
+		return r, nil
+	}
+	cfg, ok := reg.store.Room(name)
+	if !ok {
+		return nil, ErrNoRoom
+	}
+
+	r := newRoom(name, avatars)
+	r.settings = cfg.Settings
+	r.store = reg.store
+	r.bans = reg.bans
+	r.roles = reg.roles
+	r.audit = reg.audit
+	r.tracer = reg.tracer
+	r.registry = reg
+	r.idleTimeout = reg.idleTimeout
+	r.presence = reg.presence
+	r.history = reg.history
+	r.fanout = newFanout(reg.shards)
+	r.broker = reg.broker
+	reg.restoreState(r)
+	reg.rooms[name] = r
+
+	// get the room going
+	go r.run()
+	return r, nil
+}
+
+// ServeHTTP hands the web socket request on to the room named by the
+// room query parameter, defaulting to the main room.
+func (reg *roomRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("room")
+	if name == "" {
+		name = mainRoom
+	}
+	r, err := reg.get(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.ServeHTTP(w, req)
+}
+
+// createRoomHandler creates a room owned by the signed in user.
+// format: POST /rooms/create name={name}&visibility={visibility}
+func createRoomHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	name := strings.ToLower(req.FormValue("name"))
+	code, err := createRoom(userID, name, visibility(req.FormValue("visibility")))
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Location", "/chat?room="+name)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// createRoom creates a room owned by the user, returning the HTTP
+// status code that goes with the error if it fails.
+func createRoom(userID, name string, vis visibility) (int, error) {
+	if !validRoomName.MatchString(name) {
+		return http.StatusBadRequest, errors.New("Room names are lower case letters, digits and dashes")
+	}
+	switch vis {
+	case "":
+		vis = visibilityPublic
+	case visibilityPublic, visibilityPrivate, visibilityInvite:
+	default:
+		return http.StatusBadRequest, errors.New("Unknown visibility " + string(vis))
+	}
+
+	err := rooms.store.Create(roomConfig{
+		Name:       name,
+		Visibility: vis,
+		Owner:      userID,
+		Created:    time.Now(),
+		Members:    map[string]bool{userID: true},
+	})
+	if err == ErrRoomExists {
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := roles.SetRoom(name, userID, roleOwner); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+// inviteHandler makes an invite link for a room.
+// format: POST /rooms/invite room={room}&expires={duration}&uses={n}
+func inviteHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	name := req.FormValue("room")
+	cfg, ok := rooms.store.Room(name)
+	if !ok {
+		http.Error(w, ErrNoRoom.Error(), http.StatusNotFound)
+		return
+	}
+	// any member may invite to a public or invite only room, private
+	// rooms are managed by their admins
+	role := roles.Role(name, userID)
+	allowed := cfg.Members[userID] && role.can(permInvite)
+	if cfg.Visibility == visibilityPrivate {
+		allowed = role.can(permManageMembers)
+	}
+	if !allowed {
+		http.Error(w, "You are not allowed to invite people to this room", http.StatusForbidden)
+		return
+	}
+
+	ttl := 24 * time.Hour
+	if v := req.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid expires duration", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	uses := 0
+	if v := req.FormValue("uses"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid number of uses", http.StatusBadRequest)
+			return
+		}
+		uses = n
+	}
+
+	inv, err := rooms.store.CreateInvite(name, userID, ttl, uses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":     baseURL + "/invite/" + inv.Code,
+		"expires": inv.Expires,
+		"uses":    inv.MaxUses,
+	})
+}
+
+// redeemInviteHandler makes the signed in user a member of the room
+// the invite is for, then takes them to the chat.
+// format: /invite/{code}
+func redeemInviteHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	code := strings.TrimPrefix(req.URL.Path, "/invite/")
+	name, err := rooms.store.RedeemInvite(code, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Location", "/chat?room="+name)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// membersHandler lets room admins add and remove members.
+// format: POST /rooms/members room={room}&userid={userid}&action=add|remove
+func membersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	name := req.FormValue("room")
+	if !roles.Role(name, userID).can(permManageMembers) {
+		http.Error(w, "You are not allowed to manage members of this room", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch req.FormValue("action") {
+	case "add":
+		err = rooms.store.SetMember(name, req.FormValue("userid"), true)
+	case "remove":
+		err = rooms.store.SetMember(name, req.FormValue("userid"), false)
+		if err == nil {
+			rooms.removeMember(name, req.FormValue("userid"))
+		}
+	default:
+		http.Error(w, "Action must be add or remove", http.StatusBadRequest)
+		return
+	}
+	if err == ErrNoRoom {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeMember disconnects the user from the room if it is running
+// and they may no longer join it.
+func (reg *roomRegistry) removeMember(name, userID string) {
+	reg.mu.Lock()
+	r, ok := reg.rooms[name]
+	reg.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case r.removed <- userID:
+	case <-r.done:
+	}
+}
+
+// dropMember closes the clients of a user who was removed from the
+// room, unless the room is public or they are an admin.
+func (r *room) dropMember(userID string) {
+	if r.canJoin(userID) {
+		return
+	}
+	for client := range r.clients {
+		if client.userID() == userID {
+			client.closeCode = websocket.ClosePolicyViolation
+			client.closeReason = errNotMember.Error()
+		}
+	}
+	r.kick(userID)
+}
+
+// requestUserID gets the unique ID of the signed in user, writing an
+// error response if there is none.
+func requestUserID(w http.ResponseWriter, req *http.Request) (string, bool) {
+	userData, err := authUserData(req)
+	if err != nil {
+		http.Error(w, "You must be signed in", http.StatusUnauthorized)
+		return "", false
+	}
+	userID, _ := userData["userid"].(string)
+	if userID == "" {
+		http.Error(w, "You must be signed in", http.StatusUnauthorized)
+		return "", false
+	}
+	return userID, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomStoreInvites(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := loadRoomStore(filepath.Join(dir, "rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(roomConfig{Name: "secret", Visibility: visibilityInvite}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(roomConfig{Name: "secret"}); err != ErrRoomExists {
+		t.Error("Create should return ErrRoomExists for an existing room")
+	}
+
+	inv, err := store.CreateInvite("secret", "owner", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := store.RedeemInvite(inv.Code, "abc")
+	if err != nil {
+		t.Fatalf("RedeemInvite should not return an error: %s", err)
+	}
+	if name != "secret" {
+		t.Errorf("RedeemInvite wrongly returned room %s", name)
+	}
+	if !store.IsMember("secret", "abc") {
+		t.Error("redeeming an invite should make the user a member")
+	}
+
+	// the invite could only be used once
+	if _, err := store.RedeemInvite(inv.Code, "def"); err != ErrInvalidInvite {
+		t.Error("RedeemInvite should return ErrInvalidInvite for a used up invite")
+	}
+
+	expired, err := store.CreateInvite("secret", "owner", time.Nanosecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := store.RedeemInvite(expired.Code, "def"); err != ErrInvalidInvite {
+		t.Error("RedeemInvite should return ErrInvalidInvite for an expired invite")
+	}
+}
+
+func TestMembersHandler(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+	rooms.store.Create(roomConfig{Name: "team", Visibility: visibilityPrivate, Members: map[string]bool{"xyz": true}})
+	roles.SetRoom("team", "abc", roleOwner)
+	owner := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+
+	defer func(old string) { baseURL = old }(baseURL)
+	baseURL = "https://chat.example.com"
+	w := postForm(inviteHandler, "/rooms/invite", url.Values{"room": {"team"}}, owner)
+	var inv struct{ URL string }
+	json.NewDecoder(w.Body).Decode(&inv)
+	if !strings.HasPrefix(inv.URL, "https://chat.example.com/invite/") {
+		t.Errorf("the invite should link to the configured URL, got %q (%d)", inv.URL, w.Code)
+	}
+
+	r, err := rooms.get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, admin := newTestClient("xyz"), newTestClient("abc")
+	for _, c := range []*client{member, admin} {
+		c.room = r
+		if _, err := r.enter(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w = postForm(membersHandler, "/rooms/members", url.Values{"room": {"team"}, "userid": {"xyz"}, "action": {"remove"}}, owner)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("removing a member failed with %d: %s", w.Code, w.Body)
+	}
+	timeout := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-member.send:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("the client of a removed member should be closed")
+		}
+	}
+	if member.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("the client should be told it is no longer a member, got %d", member.closeCode)
+	}
+	select {
+	case _, ok := <-admin.send:
+		if !ok {
+			t.Error("the admin should stay in the room")
+		}
+	default:
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Session disimpan di server, cookie auth hanya berisi session ID yang
+	ditandatangani. Jadi logout benar-benar mengakhiri session: cookie yang
+	disalin ke tempat lain tidak bisa dipakai lagi, dan socket yang masih
+	terbuka dengan session tersebut langsung diputus.
+
+	Session berakhir setelah sessionTTL tanpa dipakai, setiap request
+	memperpanjang session yang sudah lewat separuh umurnya (sliding refresh).
+*/
+
+// ErrNoSession is returned for sessions that do not exist, or have
+// ended.
+var ErrNoSession = errors.New("chat: No such session.")
+
+// session is a signed in browser.
+type session struct {
+	ID     string
+	UserID string
+	// Data is the user information the auth cookie used to hold.
+	Data    map[string]interface{}
+	Created time.Time
+	Expires time.Time
+}
+
+// SessionStore keeps the sessions.
+type SessionStore interface {
+	// Create stores a new session.
+	Create(s *session) error
+	// Get gets the session, or ErrNoSession if it is unknown or has
+	// expired.
+	Get(id string) (*session, error)
+	// Touch moves the expiry of the session.
+	Touch(id string, expires time.Time) error
+	// Delete ends the session.
+	Delete(id string) error
+	// Take gets the session and deletes it, so of several callers
+	// taking the same session only one gets it. The others get
+	// ErrNoSession.
+	Take(id string) (*session, error)
+	// DeleteUser ends every session of the user, returning their IDs.
+	DeleteUser(userID string) ([]string, error)
+	// DeleteExpired forgets the sessions that have expired.
+	DeleteExpired() error
+}
+
+// memorySessions is a SessionStore that forgets everything when the
+// server stops.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: make(map[string]*session)}
+}
+
+func (m *memorySessions) Create(s *session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *s
+	m.sessions[s.ID] = &c
+	return nil
+}
+
+func (m *memorySessions) Get(id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.Expires) {
+		return nil, ErrNoSession
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *memorySessions) Touch(id string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	s.Expires = expires
+	return nil
+}
+
+func (m *memorySessions) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessions) Take(id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.Expires) {
+		return nil, ErrNoSession
+	}
+	delete(m.sessions, id)
+	return s, nil
+}
+
+func (m *memorySessions) DeleteUser(userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			ids = append(ids, id)
+			delete(m.sessions, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memorySessions) DeleteExpired() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, s := range m.sessions {
+		if now.After(s.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+var (
+	// sessions keeps the sessions of signed in users.
+	sessions SessionStore = newMemorySessions()
+	// sessionTTL is how long a session lasts without being used.
+	sessionTTL = 7 * 24 * time.Hour
+)
+
+// startSession signs the user in, making a new session and putting
+// its ID in the auth cookie.
+func startSession(w http.ResponseWriter, userData map[string]interface{}) error {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	userID, _ := userData["userid"].(string)
+	now := time.Now()
+	s := &session{
+		ID:      hex.EncodeToString(id),
+		UserID:  userID,
+		Data:    userData,
+		Created: now,
+		Expires: now.Add(sessionTTL),
+	}
+	if err := sessions.Create(s); err != nil {
+		return err
+	}
+	return setAuthCookie(w, map[string]interface{}{"sid": s.ID})
+}
+
+// sessionUserData gets the user data of the session, extending the
+// session once it is past half its life. The session ID is added to
+// the data as "session".
+func sessionUserData(id string) (map[string]interface{}, error) {
+	s, err := sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if time.Until(s.Expires) < sessionTTL/2 {
+		if err := sessions.Touch(id, time.Now().Add(sessionTTL)); err != nil {
+			return nil, err
+		}
+	}
+	data := make(map[string]interface{}, len(s.Data)+1)
+	for k, v := range s.Data {
+		data[k] = v
+	}
+	data["session"] = s.ID
+	return data, nil
+}
+
+// endSessions ends the sessions and disconnects their clients from
+// every room, on every node.
+func endSessions(ids ...string) error {
+	for _, id := range ids {
+		if err := sessions.Delete(id); err != nil {
+			return err
+		}
+		if rooms != nil {
+			rooms.revokeSession(id)
+		}
+	}
+	return nil
+}
+
+// expireSessions keeps forgetting expired sessions until the program
+// ends.
+func expireSessions(every time.Duration) {
+	for range time.Tick(every) {
+		sessions.DeleteExpired()
+	}
+}
+
+// sessionID gets the session the client signed in with, empty for
+// clients using an API token.
+func (c *client) sessionID() string {
+	id, _ := c.userData["session"].(string)
+	return id
+}
+
+// sessionsChannel is the broker channel ended sessions are announced
+// on. It is not a valid room name, so no room ever uses it.
+const sessionsChannel = "_sessions"
+
+// revokeSession disconnects the clients of the session, or of the
+// personal API token, from every running room. The other nodes are
+// told through the broker.
+func (reg *roomRegistry) revokeSession(id string) {
+	reg.dropSession(id)
+	if reg.broker == nil {
+		return
+	}
+	if err := reg.broker.Publish(sessionsChannel, &message{Message: id, When: time.Now(), System: true}); err != nil {
+		reg.tracer.Trace("Failed to publish an ended session: ", err)
+	}
+}
+
+// watchSessions starts disconnecting the clients of the sessions other
+// nodes end, until the program ends. Sessions this node ends come back
+// here too, dropping them again does nothing.
+func (reg *roomRegistry) watchSessions() {
+	incoming, unsubscribe, err := reg.broker.Subscribe(sessionsChannel)
+	go func() {
+		delay := resubscribeMinDelay
+		for {
+			if err != nil {
+				reg.tracer.Trace("Cannot subscribe to ended sessions: ", err)
+				time.Sleep(delay)
+				if delay *= 2; delay > resubscribeMaxDelay {
+					delay = resubscribeMaxDelay
+				}
+			} else {
+				delay = resubscribeMinDelay
+				for msg := range incoming {
+					reg.dropSession(msg.Message)
+				}
+				unsubscribe()
+			}
+			incoming, unsubscribe, err = reg.broker.Subscribe(sessionsChannel)
+		}
+	}()
+}
+
+// dropSession disconnects the clients of the session from the rooms
+// running on this node.
+func (reg *roomRegistry) dropSession(id string) {
+	reg.mu.Lock()
+	running := make([]*room, 0, len(reg.rooms))
+	for _, r := range reg.rooms {
+		running = append(running, r)
+	}
+	reg.mu.Unlock()
+
+	for _, r := range running {
+		select {
+		case r.revoke <- id:
+		case <-r.done:
+		}
+	}
+}
+
+// dropSession closes the clients of the ended session or revoked API
+// token, telling them to sign in again.
+func (r *room) dropSession(id string) {
+	for client := range r.clients {
+		if client.sessionID() != id && client.tokenID() != id {
+			continue
+		}
+		client.closeCode = websocket.ClosePolicyViolation
+		client.closeReason = "Your session has ended, please sign in again"
+		delete(r.clients, client)
+		r.fanout.remove(client)
+		r.forgetWaiting(client)
+		r.trackLeave(client)
+	}
+	r.admitWaiting()
+	r.countOccupancy()
+}
+
+// logoutHandler ends the session, or with everywhere set every
+// session of the user, and clears the cookie.
+// format: POST /logout[?everywhere=1]
+func logoutHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if userData, err := authUserData(req); err == nil {
+		if req.FormValue("everywhere") != "" {
+			userID, _ := userData["userid"].(string)
+			ids, err := sessions.DeleteUser(userID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			endSessions(ids...)
+		} else if id, _ := userData["session"].(string); id != "" {
+			endSessions(id)
+		}
+	}
+	clearAuthCookie(w)
+	w.Header().Set("Location", "/chat")
+	w.WriteHeader(http.StatusSeeOther)
+}
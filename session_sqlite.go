@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSessions is a SessionStore in a SQLite database, so sessions
+// survive restarts.
+type sqliteSessions struct {
+	db *sql.DB
+}
+
+// sqliteOptions let requests share the database: WAL lets reads go on
+// while something is written, writers wait their turn for up to five
+// seconds instead of failing with "database is locked", and
+// transactions take the write lock as they begin so two of them never
+// deadlock upgrading a read.
+const sqliteOptions = "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+
+// openSQLiteSessions opens the database at path, creating the table
+// if needed.
+func openSQLiteSessions(path string) (*sqliteSessions, error) {
+	db, err := sql.Open("sqlite3", path+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id      TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			data    TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			expires INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSessions{db: db}, nil
+}
+
+func (s *sqliteSessions) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteSessions) Create(sess *session) error {
+	data, err := json.Marshal(sess.Data)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (id, user_id, data, created, expires) VALUES (?, ?, ?, ?, ?)`,
+		sess.ID, sess.UserID, string(data), sess.Created.Unix(), sess.Expires.Unix())
+	return err
+}
+
+func (s *sqliteSessions) Get(id string) (*session, error) {
+	var data string
+	var created, expires int64
+	sess := &session{ID: id}
+	err := s.db.QueryRow(`SELECT user_id, data, created, expires FROM sessions WHERE id = ? AND expires > ?`,
+		id, time.Now().Unix()).Scan(&sess.UserID, &data, &created, &expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(data), &sess.Data); err != nil {
+		return nil, err
+	}
+	sess.Created = time.Unix(created, 0)
+	sess.Expires = time.Unix(expires, 0)
+	return sess, nil
+}
+
+func (s *sqliteSessions) Touch(id string, expires time.Time) error {
+	res, err := s.db.Exec(`UPDATE sessions SET expires = ? WHERE id = ?`, expires.Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
+
+func (s *sqliteSessions) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteSessions) Take(id string) (*session, error) {
+	sess, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	// only the caller whose delete removed the row took it
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNoSession
+	}
+	return sess, nil
+}
+
+func (s *sqliteSessions) DeleteUser(userID string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func (s *sqliteSessions) DeleteExpired() error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires <= ?`, time.Now().Unix())
+	return err
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+
+	now := time.Now()
+	for _, s := range []*session{
+		{ID: "one", UserID: "abc", Data: map[string]interface{}{"name": "Abc"}, Created: now, Expires: now.Add(time.Hour)},
+		{ID: "two", UserID: "abc", Data: map[string]interface{}{}, Created: now, Expires: now.Add(time.Hour)},
+		{ID: "old", UserID: "xyz", Data: map[string]interface{}{}, Created: now, Expires: now.Add(-time.Hour)},
+	} {
+		if err := store.Create(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := store.Get("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UserID != "abc" || s.Data["name"] != "Abc" {
+		t.Errorf("Get wrongly returned %+v", s)
+	}
+	if _, err := store.Get("old"); err != ErrNoSession {
+		t.Errorf("an expired session should not be found, got %v", err)
+	}
+	if _, err := store.Get("nope"); err != ErrNoSession {
+		t.Errorf("an unknown session should not be found, got %v", err)
+	}
+
+	if err := store.Create(&session{ID: "once", Data: map[string]interface{}{}, Created: now, Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := store.Take("once"); err != nil || s.ID != "once" {
+		t.Errorf("Take wrongly gave %v, %v", s, err)
+	}
+	if _, err := store.Take("once"); err != ErrNoSession {
+		t.Errorf("a session should only be taken once, got %v", err)
+	}
+
+	if err := store.Touch("one", now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := store.Get("one"); s.Expires.Before(now.Add(time.Hour + time.Minute)) {
+		t.Errorf("Touch should move the expiry, got %v", s.Expires)
+	}
+
+	ids, err := store.DeleteUser("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("DeleteUser should end both sessions, got %v", ids)
+	}
+	if _, err := store.Get("two"); err != ErrNoSession {
+		t.Error("the sessions of the user should be gone")
+	}
+	if err := store.DeleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Touch("old", now.Add(time.Hour)); err != ErrNoSession {
+		t.Error("DeleteExpired should forget the expired session")
+	}
+}
+
+func TestMemorySessions(t *testing.T) {
+	testSessionStore(t, newMemorySessions())
+}
+
+func TestSQLiteSessions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := openSQLiteSessions(filepath.Join(dir, "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testSessionStore(t, store)
+}
+
+// TestSQLiteSessionsConcurrent uses the database from many goroutines
+// and two stores at once, as with several requests on several nodes.
+func TestSQLiteSessionsConcurrent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stores [2]*sqliteSessions
+	for i := range stores {
+		if stores[i], err = openSQLiteSessions(filepath.Join(dir, "sessions.db")); err != nil {
+			t.Fatal(err)
+		}
+		defer stores[i].Close()
+	}
+
+	errs := make(chan error, 16)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := stores[i%len(stores)]
+			userID := fmt.Sprint("user", i%4)
+			for j := 0; j < 25; j++ {
+				now := time.Now()
+				id := fmt.Sprint(i, "-", j)
+				err := store.Create(&session{ID: id, UserID: userID, Data: map[string]interface{}{}, Created: now, Expires: now.Add(time.Hour)})
+				if err == nil {
+					_, err = store.Get(id)
+				}
+				if err == nil || err == ErrNoSession {
+					err = store.Touch(id, now.Add(2*time.Hour))
+				}
+				if err == nil || err == ErrNoSession {
+					_, err = store.DeleteUser(userID)
+				}
+				if err != nil && err != ErrNoSession {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+
+	sessions = newMemorySessions()
+	now := time.Now()
+	sessions.Create(&session{ID: "abc", UserID: "abc", Created: now, Expires: now.Add(sessionTTL / 4)})
+
+	userData, err := sessionUserData("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userData["session"] != "abc" {
+		t.Errorf("the user data should name the session, got %v", userData)
+	}
+	if s, _ := sessions.Get("abc"); time.Until(s.Expires) < sessionTTL/2 {
+		t.Error("a session past half its life should be extended")
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+
+	cookie := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	other := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(cookie)
+	userData, err := authUserData(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket of the session in the main room
+	r, _ := rooms.get(mainRoom)
+	c := newTestClient("abc")
+	c.userData["session"] = userData["session"]
+	c.room = r
+	if _, err := r.enter(c); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookie)
+	logoutHandler(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(cookie)
+	if _, err := authUserData(req); err != ErrInvalidCookie {
+		t.Errorf("the cookie of an ended session should be refused, got %v", err)
+	}
+	req = httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(other)
+	if _, err := authUserData(req); err != nil {
+		t.Errorf("logging out should keep the other sessions, got %v", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-c.send:
+			if ok {
+				continue
+			}
+			if c.closeCode != websocket.ClosePolicyViolation {
+				t.Errorf("the client should be told its session ended, got %d", c.closeCode)
+			}
+		case <-timeout:
+			t.Fatal("the socket of an ended session should be closed")
+		}
+		break
+	}
+
+	req = httptest.NewRequest("POST", "/logout?everywhere=1", nil)
+	req.AddCookie(other)
+	logoutHandler(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(other)
+	if _, err := authUserData(req); err != ErrInvalidCookie {
+		t.Errorf("logging out everywhere should end every session, got %v", err)
+	}
+}
+
+// TestRevokeOnOtherNode ends a session on one node while its client,
+// waiting for a seat in a full room, is connected to another.
+func TestRevokeOnOtherNode(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	rooms.store.SetSettings(mainRoom, roomSettings{MaxMembers: 1, Overflow: overflowReadOnly})
+
+	broker := newMemoryBroker()
+	other := newRoomRegistry(rooms.store)
+	other.bans, other.roles = bans, roles
+	rooms.broker, other.broker = broker, broker
+	other.watchSessions()
+
+	r, err := other.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seated, waiting := newTestClient("xyz"), newTestClient("abc")
+	waiting.userData["session"] = "ended"
+	for _, c := range []*client{seated, waiting} {
+		c.room = r
+		if _, err := r.enter(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rooms.revokeSession("ended")
+	timeout := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-waiting.send:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("the client of the ended session should be closed on the other node")
+		}
+	}
+	if waiting.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("the client should be told its session ended, got %d", waiting.closeCode)
+	}
+	if info, _ := other.info(mainRoom); info.Waiting != 0 {
+		t.Errorf("the client should no longer wait for a seat, %d waiting", info.Waiting)
+	}
+}
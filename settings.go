@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// roomSettings are the settings room admins can change.
+type roomSettings struct {
+	Title       string
+	Topic       string
+	Description string
+	// MaxMembers limits how many people can be in the room at once,
+	// zero means no limit.
+	MaxMembers int
+	// RetentionDays is how long messages are kept, zero keeps them
+	// forever.
+	RetentionDays int
+	// SlowMode is the number of seconds each member has to wait
+	// between messages, zero turns slow mode off.
+	SlowMode int
+	// Overflow says what happens to people joining once MaxMembers
+	// is reached, overflowReject (the default) or overflowReadOnly.
+	Overflow string
+}
+
+// settingKeys are the names used for the settings in forms and in
+// the /set command.
+var settingKeys = []string{"title", "topic", "description", "max_members", "retention_days", "slow_mode", "overflow"}
+
+// set changes a single setting by name, checking the new value.
+func (s *roomSettings) set(key, value string) error {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "title":
+		return setText(&s.Title, value, 64)
+	case "topic":
+		return setText(&s.Topic, value, 256)
+	case "description":
+		return setText(&s.Description, value, 1024)
+	case "max_members":
+		return setCount(&s.MaxMembers, value)
+	case "retention_days":
+		return setCount(&s.RetentionDays, value)
+	case "slow_mode":
+		return setCount(&s.SlowMode, value)
+	case "overflow":
+		if value != overflowReject && value != overflowReadOnly {
+			return fmt.Errorf("must be %s or %s", overflowReject, overflowReadOnly)
+		}
+		s.Overflow = value
+		return nil
+	}
+	return fmt.Errorf("unknown setting %s", key)
+}
+
+func setText(field *string, value string, max int) error {
+	if len(value) > max {
+		return fmt.Errorf("must be at most %d characters", max)
+	}
+	*field = value
+	return nil
+}
+
+func setCount(field *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("must be a whole number, 0 or more")
+	}
+	*field = n
+	return nil
+}
+
+// SetSettings replaces the settings of the room and saves them.
+func (s *roomStore) SetSettings(name string, settings roomSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, ok := s.data.Rooms[name]
+	if !ok {
+		return ErrNoRoom
+	}
+	cfg.Settings = settings
+	return saveJSON(s.path, s.data)
+}
+
+// settingError is a setting given a value it cannot take, or a
+// setting that does not exist.
+type settingError struct {
+	key string
+	err error
+}
+
+func (e *settingError) Error() string {
+	return "Invalid " + e.key + ": " + e.err.Error()
+}
+
+// UpdateSettings changes only the given settings of the room, keeping
+// the others as they are in the store, and saves them. Nothing is
+// changed if one of them is invalid.
+func (s *roomStore) UpdateSettings(name string, changes map[string]string) (roomSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, ok := s.data.Rooms[name]
+	if !ok {
+		return roomSettings{}, ErrNoRoom
+	}
+	settings := cfg.Settings
+	for key, value := range changes {
+		if err := settings.set(key, value); err != nil {
+			return roomSettings{}, &settingError{key: key, err: err}
+		}
+	}
+	cfg.Settings = settings
+	if err := saveJSON(s.path, s.data); err != nil {
+		return roomSettings{}, err
+	}
+	return settings, nil
+}
+
+// handleSettingsCommand carries out /topic and /set. Like
+// handleCommand it runs inside the room goroutine.
+//
+//	/topic <text>
+//	/set <setting> <value>
+func (r *room) handleSettingsCommand(cmd *command) {
+	if !r.can(cmd.client.userID(), permManageRoom) {
+		r.notify(cmd.client.userID(), "You are not allowed to change the room settings")
+		return
+	}
+
+	key, value := "topic", strings.Join(cmd.args, " ")
+	if cmd.name == "set" {
+		if len(cmd.args) == 0 {
+			r.notify(cmd.client.userID(), "Usage: /set <"+strings.Join(settingKeys, "|")+"> <value>")
+			return
+		}
+		key, value = cmd.args[0], strings.Join(cmd.args[1:], " ")
+	}
+
+	update := settingsUpdate{
+		changes: map[string]string{key: value},
+		text:    fmt.Sprintf("%s changed the %s", cmd.client.name(), key),
+	}
+	if _, err := r.updateSettings(update); err != nil {
+		r.notify(cmd.client.userID(), err.Error())
+	}
+}
+
+// updateSettings merges the changes into the stored settings and
+// starts using them. It runs inside the room goroutine, so changes
+// made at the same time through the page and through /set are all
+// kept.
+func (r *room) updateSettings(update settingsUpdate) (roomSettings, error) {
+	settings, err := r.store.UpdateSettings(r.name, update.changes)
+	if err != nil {
+		return roomSettings{}, err
+	}
+	r.applySettings(settings, update.text)
+	return settings, nil
+}
+
+// applySettings starts using the new settings and tells everyone in
+// the room, on every node, about them.
+func (r *room) applySettings(settings roomSettings, text string) {
+	r.settings = settings
+	msg := newSystemMessage(text)
+	msg.Settings = &settings
+	r.publish(msg)
+}
+
+// settingsHandler shows or changes the settings of a room. Only the
+// settings present in a POST are changed.
+// format: GET /rooms/settings?room={room}
+// format: POST /rooms/settings room={room}&topic={topic}&...
+func settingsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	name := req.FormValue("room")
+	cfg, ok := rooms.store.Room(name)
+	if !ok || !cfg.visibleTo(userID) {
+		http.Error(w, ErrNoRoom.Error(), http.StatusNotFound)
+		return
+	}
+	settings := cfg.Settings
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if !roles.Role(name, userID).can(permManageRoom) {
+			http.Error(w, "You are not allowed to change the room settings", http.StatusForbidden)
+			return
+		}
+
+		changes := make(map[string]string)
+		var changed []string
+		for _, key := range settingKeys {
+			if _, present := req.PostForm[key]; present {
+				changes[key] = req.PostFormValue(key)
+				changed = append(changed, key)
+			}
+		}
+		if len(changes) == 0 {
+			break
+		}
+		var err error
+		settings, err = rooms.changeSettings(name, settingsUpdate{
+			changes: changes,
+			text:    "The room " + strings.Join(changed, ", ") + " changed",
+		})
+		if _, invalid := err.(*settingError); invalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// changeSettings has the room make the changes if it is running, so
+// they are made in turn with the /set commands. A room that is not
+// running reads the new settings from the store when it starts, the
+// registry stays locked so it cannot start in between.
+func (reg *roomRegistry) changeSettings(name string, update settingsUpdate) (roomSettings, error) {
+	reg.mu.Lock()
+	r, ok := reg.rooms[name]
+	if !ok {
+		defer reg.mu.Unlock()
+		return reg.store.UpdateSettings(name, update.changes)
+	}
+	reg.mu.Unlock()
+
+	update.done = make(chan settingsResult, 1)
+	select {
+	case r.settingsUpdates <- update:
+		result := <-update.done
+		return result.settings, result.err
+	case <-r.done:
+		// stopped meanwhile, try again with whatever runs now
+		return reg.changeSettings(name, update)
+	}
+}
+
+// settingsUpdate is a change to some of the room settings along with
+// the announcement made to the room. done, if set, is given the
+// outcome.
+type settingsUpdate struct {
+	changes map[string]string
+	text    string
+	done    chan settingsResult
+}
+
+type settingsResult struct {
+	settings roomSettings
+	err      error
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoomSettingsSet(t *testing.T) {
+
+	var s roomSettings
+	for _, c := range []struct {
+		key, value string
+		ok         bool
+	}{
+		{"title", " Team chat ", true},
+		{"topic", strings.Repeat("x", 256), true},
+		{"topic", strings.Repeat("x", 257), false},
+		{"max_members", "10", true},
+		{"max_members", "-1", false},
+		{"slow_mode", "ten", false},
+		{"overflow", overflowReadOnly, true},
+		{"overflow", "drop", false},
+		{"colour", "red", false},
+	} {
+		if err := s.set(c.key, c.value); (err == nil) != c.ok {
+			t.Errorf("set(%q, %q) gave %v", c.key, c.value, err)
+		}
+	}
+	want := roomSettings{Title: "Team chat", Topic: strings.Repeat("x", 256), MaxMembers: 10, Overflow: overflowReadOnly}
+	if s != want {
+		t.Errorf("set wrongly gave %+v", s)
+	}
+}
+
+func TestSettingsHandler(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+	roles.SetRoom(mainRoom, "abc", roleOwner)
+	owner := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	member := testAuthCookie(t, map[string]interface{}{"userid": "xyz", "name": "Xyz"})
+
+	settings := func(w *httptest.ResponseRecorder) roomSettings {
+		t.Helper()
+		var s roomSettings
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		return s
+	}
+
+	if w := postForm(settingsHandler, "/rooms/settings", url.Values{"room": {mainRoom}, "topic": {"hi"}}, member); w.Code != http.StatusForbidden {
+		t.Errorf("members should not change the settings, got %d", w.Code)
+	}
+	w := postForm(settingsHandler, "/rooms/settings", url.Values{"room": {mainRoom}, "title": {"Main"}, "topic": {"Welcome"}}, owner)
+	if s := settings(w); s.Title != "Main" || s.Topic != "Welcome" {
+		t.Errorf("the settings should be changed, got %+v", s)
+	}
+	w = postForm(settingsHandler, "/rooms/settings", url.Values{"room": {mainRoom}, "topic": {"Other"}, "max_members": {"many"}}, owner)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("an invalid value should be refused, got %d", w.Code)
+	}
+	if cfg, _ := rooms.store.Room(mainRoom); cfg.Settings.Topic != "Welcome" {
+		t.Errorf("nothing should change when a value is invalid, got %+v", cfg.Settings)
+	}
+
+	// with the room running, changes to different settings made at
+	// the same time through the page and /set are all kept
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient("abc")
+	c.room = r
+	if _, err := r.enter(c); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i, key := range []string{"description", "max_members", "retention_days"} {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			postForm(settingsHandler, "/rooms/settings", url.Values{"room": {mainRoom}, key: {fmt.Sprint(i + 5)}}, owner)
+		}(i, key)
+	}
+	if !c.submit(&message{Message: "/set slow_mode 30"}) {
+		t.Fatal("the room stopped")
+	}
+	wg.Wait()
+
+	want := roomSettings{Title: "Main", Topic: "Welcome", Description: "5", MaxMembers: 6, RetentionDays: 7, SlowMode: 30}
+	timeout := time.After(time.Second)
+	for {
+		if cfg, _ := rooms.store.Room(mainRoom); cfg.Settings == want {
+			break
+		}
+		select {
+		case <-c.send:
+		case <-timeout:
+			cfg, _ := rooms.store.Room(mainRoom)
+			t.Fatalf("every change should be kept, got %+v", cfg.Settings)
+		}
+	}
+	req := httptest.NewRequest("GET", "/rooms/settings?room="+mainRoom, nil)
+	req.AddCookie(owner)
+	w = httptest.NewRecorder()
+	settingsHandler(w, req)
+	if s := settings(w); s != want {
+		t.Errorf("GET wrongly gave %+v", s)
+	}
+}
+
+func TestSetCommand(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	roles.SetRoom(mainRoom, "abc", roleOwner)
+
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, member := newTestClient("abc"), newTestClient("xyz")
+	for _, c := range []*client{owner, member} {
+		c.room = r
+		if _, err := r.enter(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// next gets the next message the client is sent
+	next := func(c *client) *message {
+		t.Helper()
+		select {
+		case msg := <-c.send:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message was sent")
+		}
+		return nil
+	}
+
+	member.submit(&message{Message: "/topic taken over"})
+	if msg := next(member); !strings.Contains(msg.Message, "not allowed") {
+		t.Errorf("members should not change the topic, got %q", msg.Message)
+	}
+	owner.submit(&message{Message: "/set max_members lots"})
+	if msg := next(owner); !strings.HasPrefix(msg.Message, "Invalid max_members") {
+		t.Errorf("an invalid value should be refused, got %q", msg.Message)
+	}
+
+	owner.submit(&message{Message: "/topic  Release day "})
+	msg := next(member)
+	if !msg.System || msg.Settings == nil || msg.Settings.Topic != "Release day" {
+		t.Errorf("everybody should get the new settings, got %+v", msg)
+	}
+	if cfg, _ := rooms.store.Room(mainRoom); cfg.Settings.Topic != "Release day" {
+		t.Errorf("the topic should be saved, got %+v", cfg.Settings)
+	}
+}
+
+func TestHiddenRoomSettings(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	sessions = newMemorySessions()
+	rooms.store.Create(roomConfig{
+		Name:       "secret",
+		Visibility: visibilityInvite,
+		Members:    map[string]bool{"abc": true},
+		Settings:   roomSettings{Topic: "Plans"},
+	})
+	member := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	outsider := testAuthCookie(t, map[string]interface{}{"userid": "xyz", "name": "Xyz"})
+
+	for _, handler := range []http.HandlerFunc{settingsHandler, roomInfoHandler} {
+		get := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/rooms/info?room=secret", nil)
+			req.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			handler(w, req)
+			return w
+		}
+		if w := get(outsider); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "Plans") {
+			t.Errorf("an invite only room should be hidden from others, got %d: %s", w.Code, w.Body)
+		}
+		if w := get(member); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Plans") {
+			t.Errorf("members should see the room, got %d: %s", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+)
+
+// slowModeWait returns how long the user has to wait before posting
+// again while slow mode is on, or zero if the message can go out now,
+// in which case the time is noted for the next message. Moderators
+// are never slowed down.
+func (r *room) slowModeWait(userID string) time.Duration {
+	if r.settings.SlowMode <= 0 || r.can(userID, permModerate) {
+		return 0
+	}
+
+	now := time.Now()
+	interval := time.Duration(r.settings.SlowMode) * time.Second
+	if last, ok := r.lastPosted[userID]; ok {
+		if wait := last.Add(interval).Sub(now); wait > 0 {
+			// round up so nobody is told to wait 0s
+			return (wait + time.Second - 1).Truncate(time.Second)
+		}
+	}
+	r.lastPosted[userID] = now
+	return 0
+}
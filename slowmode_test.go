@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowModeWait(t *testing.T) {
+
+	roles := &roleStore{defaultRole: roleMember}
+	roles.assigned.Global = map[string]role{"mod": roleModerator}
+
+	r := newRoom("main", nil)
+	r.roles = roles
+
+	if wait := r.slowModeWait("abc"); wait != 0 {
+		t.Errorf("slowModeWait should be 0 when slow mode is off, got %s", wait)
+	}
+
+	r.settings.SlowMode = 30
+
+	if wait := r.slowModeWait("abc"); wait != 0 {
+		t.Errorf("the first message should not have to wait, got %s", wait)
+	}
+	if wait := r.slowModeWait("abc"); wait != 30*time.Second {
+		t.Errorf("the second message should wait 30s, got %s", wait)
+	}
+
+	r.lastPosted["abc"] = time.Now().Add(-31 * time.Second)
+	if wait := r.slowModeWait("abc"); wait != 0 {
+		t.Errorf("slowModeWait should be 0 once the interval has passed, got %s", wait)
+	}
+
+	r.slowModeWait("mod")
+	if wait := r.slowModeWait("mod"); wait != 0 {
+		t.Errorf("moderators should be exempt from slow mode, got %s", wait)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Personal API token untuk bot dan script. User membuat token sendiri
+	di halaman /tokens, memberi nama, scope dan masa berlaku. Token hanya
+	ditampilkan sekali waktu dibuat, yang disimpan hanya hash SHA-256-nya,
+	jadi file token yang bocor tidak bisa dipakai untuk masuk.
+
+	Token dipakai lewat header "Authorization: Bearer {token}" atau, untuk
+	web socket dari client yang tidak bisa mengatur header, lewat
+	subprotocol "bearer.{token}" di samping "chat.json"/"chat.msgpack".
+	Format harus ikut dikirim: server hanya boleh menjawab dengan salah satu
+	subprotocol dari client dan tidak pernah mengembalikan token-nya.
+
+	Scope:
+		read  - masuk ke room dan membaca pesan
+		write - mengirim pesan dan membuat room
+		admin - command moderasi dan setting room
+
+	Token dari operator (api_tokens.json) dan cookie browser tidak punya
+	batasan scope. Token tidak bisa dipakai untuk mengatur token lain,
+	halaman /tokens hanya untuk browser yang sudah sign in.
+*/
+
+// scope is what an API token may be used for.
+type scope string
+
+const (
+	scopeRead  scope = "read"
+	scopeWrite scope = "write"
+	scopeAdmin scope = "admin"
+)
+
+// allScopes lists the scopes in the order they are shown.
+var allScopes = []scope{scopeRead, scopeWrite, scopeAdmin}
+
+const (
+	// userTokenPrefix starts every personal token, so leaked tokens
+	// are easy to search for.
+	userTokenPrefix = "chat_"
+	// tokenSubprotocolPrefix marks the web socket subprotocol carrying
+	// a token.
+	tokenSubprotocolPrefix = "bearer."
+	// maxUserTokens is how many tokens one user may hold.
+	maxUserTokens = 20
+	// tokenUseRecorded is how precisely the last use of a token is
+	// kept, so busy bots do not rewrite the file on every request.
+	tokenUseRecorded = time.Minute
+)
+
+var (
+	ErrTokenName     = errors.New("The token needs a name")
+	ErrTokenScopes   = errors.New("The token needs at least one known scope")
+	ErrTooManyTokens = errors.New("You have too many tokens, revoke one first")
+	ErrNoToken       = errors.New("No such token")
+	ErrInvalidToken  = errors.New("The API token is unknown or has expired")
+	errTokenScope    = errors.New("Your API token does not allow this")
+)
+
+// userToken is a token a user made for their bots and scripts.
+type userToken struct {
+	ID     string
+	UserID string
+	// Name and AvatarURL are who the user was when the token was
+	// made, and are used for the messages it sends.
+	Name      string
+	AvatarURL string
+	// Label is what the user called the token.
+	Label string
+	// Hint is the end of the token, to tell tokens apart.
+	Hint     string
+	Scopes   []scope
+	Created  time.Time
+	Expires  time.Time `json:",omitempty"`
+	LastUsed time.Time `json:",omitempty"`
+}
+
+// expired reports whether the token can no longer be used.
+func (t *userToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// Expired reports whether the token can no longer be used, for the
+// management page.
+func (t userToken) Expired() bool {
+	return t.expired(time.Now())
+}
+
+// userTokenStore keeps the personal tokens, by the hash of the token.
+type userTokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*userToken
+}
+
+// loadUserTokens reads the tokens stored at path.
+func loadUserTokens(path string) (*userTokenStore, error) {
+	s := &userTokenStore{path: path}
+	if err := loadJSON(path, &s.tokens); err != nil {
+		return nil, err
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]*userToken)
+	}
+	return s, nil
+}
+
+// hashToken is how a token is kept in the store.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes checks the scopes asked for, in the order they are
+// shown, without duplicates.
+func parseScopes(names []string) ([]scope, error) {
+	asked := make(map[scope]bool, len(names))
+	for _, name := range names {
+		asked[scope(name)] = true
+	}
+	var scopes []scope
+	for _, s := range allScopes {
+		if asked[s] {
+			scopes = append(scopes, s)
+			delete(asked, s)
+		}
+	}
+	if len(scopes) == 0 || len(asked) > 0 {
+		return nil, ErrTokenScopes
+	}
+	return scopes, nil
+}
+
+// Create makes a new token acting as the user. The token itself is
+// only returned here. A zero expires never expires.
+func (s *userTokenStore) Create(userData map[string]interface{}, label string, scopes []scope, expires time.Time) (string, userToken, error) {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return "", userToken{}, ErrTokenName
+	}
+	if len(scopes) == 0 {
+		return "", userToken{}, ErrTokenScopes
+	}
+	userID, _ := userData["userid"].(string)
+
+	id, err := randomToken(8)
+	if err != nil {
+		return "", userToken{}, err
+	}
+	secret, err := randomToken(20)
+	if err != nil {
+		return "", userToken{}, err
+	}
+	token := userTokenPrefix + secret
+
+	t := &userToken{
+		ID:      id,
+		UserID:  userID,
+		Label:   label,
+		Hint:    secret[len(secret)-4:],
+		Scopes:  scopes,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	t.Name, _ = userData["name"].(string)
+	t.AvatarURL, _ = userData["avatar_url"].(string)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := 0
+	for _, other := range s.tokens {
+		if other.UserID == userID {
+			held++
+		}
+	}
+	if held >= maxUserTokens {
+		return "", userToken{}, ErrTooManyTokens
+	}
+	hash := hashToken(token)
+	s.tokens[hash] = t
+	if err := saveJSON(s.path, s.tokens); err != nil {
+		delete(s.tokens, hash)
+		return "", userToken{}, err
+	}
+	return token, *t, nil
+}
+
+// Lookup gets the token, if it is known and has not expired, and
+// notes that it was used.
+func (s *userTokenStore) Lookup(token string) (userToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[hashToken(token)]
+	now := time.Now()
+	if !ok || t.expired(now) {
+		return userToken{}, false
+	}
+	if now.Sub(t.LastUsed) >= tokenUseRecorded {
+		t.LastUsed = now
+		saveJSON(s.path, s.tokens)
+	}
+	return *t, true
+}
+
+// List gets the tokens of the user, oldest first.
+func (s *userTokenStore) List(userID string) []userToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []userToken{}
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			list = append(list, *t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Revoke deletes a token of the user.
+func (s *userTokenStore) Revoke(userID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.tokens {
+		if t.ID != id || t.UserID != userID {
+			continue
+		}
+		delete(s.tokens, hash)
+		if err := saveJSON(s.path, s.tokens); err != nil {
+			s.tokens[hash] = t
+			return err
+		}
+		return nil
+	}
+	return ErrNoToken
+}
+
+var userTokens = &userTokenStore{tokens: make(map[string]*userToken)}
+
+// requestToken gets the API token sent with the request, from the
+// Authorization header or else from a web socket subprotocol.
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if token := strings.TrimPrefix(auth, "Bearer "); token != auth {
+			return token
+		}
+		return ""
+	}
+	for _, protocol := range websocket.Subprotocols(req) {
+		if strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, tokenSubprotocolPrefix)
+		}
+	}
+	return ""
+}
+
+// errTokenSubprotocol refuses a web socket sending its token as a
+// subprotocol without asking for a frame format. The handshake has to
+// answer with one of the client's subprotocols and the token is never
+// sent back, so browsers would reject the connection.
+var errTokenSubprotocol = errors.New("Send chat.json or chat.msgpack along with the bearer subprotocol")
+
+// checkTokenSubprotocol makes sure a web socket sending its token as a
+// subprotocol also asks for a format.
+func checkTokenSubprotocol(req *http.Request) error {
+	bearer, format := false, false
+	for _, protocol := range websocket.Subprotocols(req) {
+		if strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			bearer = true
+		}
+		for _, known := range subprotocols {
+			format = format || protocol == known
+		}
+	}
+	if bearer && !format {
+		return errTokenSubprotocol
+	}
+	return nil
+}
+
+// tokenUserData gets the user a personal or operator token acts as,
+// in the same form as the cookie data. Personal tokens add the token
+// ID and its scopes.
+func tokenUserData(token string) (map[string]interface{}, bool) {
+	if token == "" {
+		return nil, false
+	}
+	if t, ok := userTokens.Lookup(token); ok {
+		return map[string]interface{}{
+			"userid":     t.UserID,
+			"name":       t.Name,
+			"avatar_url": t.AvatarURL,
+			"token":      t.ID,
+			"scopes":     t.Scopes,
+		}, true
+	}
+	user, ok := apiTokens.Lookup(token)
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"userid":     user.UserID,
+		"name":       user.Name,
+		"avatar_url": user.AvatarURL,
+	}, true
+}
+
+// requestUserData gets the user of a request from its API token, or
+// else from the auth cookie. A token that is sent but not known gives
+// ErrInvalidToken.
+func requestUserData(req *http.Request) (map[string]interface{}, error) {
+	token := requestToken(req)
+	if token == "" && req.Header.Get("Authorization") == "" {
+		return authUserData(req)
+	}
+	userData, ok := tokenUserData(token)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return userData, nil
+}
+
+// hasScope reports whether the user may do what the scope allows.
+// Only personal tokens are limited.
+func hasScope(userData map[string]interface{}, s scope) bool {
+	scopes, ok := userData["scopes"].([]scope)
+	if !ok {
+		return true
+	}
+	for _, held := range scopes {
+		if held == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenID gets the personal token the client connected with, empty
+// for everybody else.
+func (c *client) tokenID() string {
+	id, _ := c.userData["token"].(string)
+	return id
+}
+
+// tokenLifetimes are the choices of how long a new token lasts, in
+// days, 0 never expiring.
+var tokenLifetimes = []int{7, 30, 90, 365, 0}
+
+// tokensPage is template/tokens.html.
+var tokensPage = &page{filename: "tokens.html"}
+
+// renderTokens shows the tokens of the user, with the token just made
+// if there is one.
+func renderTokens(w http.ResponseWriter, req *http.Request, status int, userID, newToken string) {
+	data := map[string]interface{}{
+		"CSRF":      csrfToken(w, req),
+		"Tokens":    userTokens.List(userID),
+		"NewToken":  newToken,
+		"Scopes":    allScopes,
+		"Lifetimes": tokenLifetimes,
+	}
+	if err := tokensPage.render(w, status, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// tokensHandler shows the management page. Only the browser session
+// may use it, not a token.
+// format: GET /tokens
+func tokensHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	renderTokens(w, req, http.StatusOK, userID, "")
+}
+
+// createTokenHandler makes a token and shows it, the only time it can
+// be seen.
+// format: POST /tokens/create label={label}&scope={scope}...&days={days}
+func createTokenHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, err := authUserData(req)
+	if err != nil {
+		http.Error(w, "You must be signed in", http.StatusUnauthorized)
+		return
+	}
+	req.ParseForm()
+	scopes, err := parseScopes(req.Form["scope"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expires time.Time
+	days, err := strconv.Atoi(req.FormValue("days"))
+	if err != nil || days < 0 {
+		http.Error(w, "Invalid lifetime", http.StatusBadRequest)
+		return
+	}
+	if days > 0 {
+		expires = time.Now().AddDate(0, 0, days)
+	}
+
+	token, t, err := userTokens.Create(userData, req.FormValue("label"), scopes, expires)
+	switch err {
+	case nil:
+	case ErrTokenName, ErrTokenScopes, ErrTooManyTokens:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTokens(w, req, http.StatusCreated, t.UserID, token)
+}
+
+// revokeTokenHandler deletes a token of the user and disconnects the
+// clients using it.
+// format: POST /tokens/revoke id={id}
+func revokeTokenHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	id := req.FormValue("id")
+	err := userTokens.Revoke(userID, id)
+	switch err {
+	case nil:
+	case ErrNoToken:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rooms != nil {
+		rooms.revokeSession(id)
+	}
+	w.Header().Set("Location", "/tokens")
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUserTokenStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user_tokens.json")
+	s, err := loadUserTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mat := map[string]interface{}{"userid": "abc", "name": "Mat"}
+
+	if _, _, err := s.Create(mat, " ", []scope{scopeRead}, time.Time{}); err != ErrTokenName {
+		t.Errorf("a token without a name should be refused, got %v", err)
+	}
+	if _, err := parseScopes([]string{"read", "root"}); err != ErrTokenScopes {
+		t.Errorf("unknown scopes should be refused, got %v", err)
+	}
+	if scopes, _ := parseScopes([]string{"write", "read", "write"}); len(scopes) != 2 || scopes[0] != scopeRead {
+		t.Errorf("parseScopes wrongly gave %v", scopes)
+	}
+
+	token, made, err := s.Create(mat, "bot", []scope{scopeRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, userTokenPrefix) || !strings.HasSuffix(token, made.Hint) {
+		t.Errorf("Create wrongly gave %q with hint %q", token, made.Hint)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), token) {
+		t.Error("only the hash of the token should be stored")
+	}
+	if got, ok := s.Lookup(token); !ok || got.UserID != "abc" || got.Name != "Mat" {
+		t.Errorf("Lookup wrongly gave %+v, %v", got, ok)
+	}
+	if _, ok := s.Lookup(token + "x"); ok {
+		t.Error("an unknown token should not be found")
+	}
+
+	old, _, err := s.Create(mat, "old", []scope{scopeRead}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Lookup(old); ok {
+		t.Error("an expired token should not be accepted")
+	}
+
+	reloaded, err := loadUserTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Lookup(token); !ok {
+		t.Error("tokens should be kept in the file")
+	}
+	if list := reloaded.List("abc"); len(list) != 2 || list[0].Label != "bot" || !list[1].Expired() {
+		t.Errorf("List wrongly gave %+v", list)
+	}
+
+	if err := s.Revoke("xyz", made.ID); err != ErrNoToken {
+		t.Errorf("only the owner should revoke a token, got %v", err)
+	}
+	if err := s.Revoke("abc", made.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Lookup(token); ok {
+		t.Error("a revoked token should not be accepted")
+	}
+}
+
+func TestTokenRequests(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	if userTokens, err = loadUserTokens(filepath.Join(dir, "user_tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	mat := map[string]interface{}{"userid": "abc", "name": "Mat"}
+	reader, _, err := userTokens.Create(mat, "reader", []scope{scopeRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _, err := userTokens.Create(mat, "writer", []scope{scopeWrite}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := func(method, path, token string) *http.Request {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"Message":"hello"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	userData, err := requestUserData(bearer("GET", "/room", reader))
+	if err != nil || userData["userid"] != "abc" || !hasScope(userData, scopeRead) || hasScope(userData, scopeWrite) {
+		t.Errorf("a bearer token wrongly gave %v, %v", userData, err)
+	}
+	req := httptest.NewRequest("GET", "/room", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", subprotocolJSON+", "+tokenSubprotocolPrefix+reader)
+	if userData, err := requestUserData(req); err != nil || userData["userid"] != "abc" {
+		t.Errorf("a token subprotocol wrongly gave %v, %v", userData, err)
+	}
+	if _, err := requestUserData(bearer("GET", "/room", "wrong")); err != ErrInvalidToken {
+		t.Errorf("an unknown token should give ErrInvalidToken, got %v", err)
+	}
+
+	called := false
+	next := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	next.ServeHTTP(httptest.NewRecorder(), bearer("GET", "/invite/x", reader))
+	if !called {
+		t.Error("authHandler should accept a token")
+	}
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, bearer("GET", "/invite/x", "wrong"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("authHandler should refuse an unknown token, got %d", w.Code)
+	}
+
+	r, err := rooms.get(mainRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.authorize(httptest.NewRecorder(), bearer("GET", "/room", reader)); !ok {
+		t.Error("a read token should join the room")
+	}
+	w = httptest.NewRecorder()
+	if _, ok := r.authorize(w, bearer("GET", "/room", writer)); ok || w.Code != http.StatusForbidden {
+		t.Errorf("a token without read should not join the room, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	apiHandler(w, bearer("POST", "/api/v1/rooms/main/messages", reader))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a read token should not post, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	apiHandler(w, bearer("POST", "/api/v1/rooms/main/messages", writer))
+	if w.Code != http.StatusCreated {
+		t.Errorf("a write token should post, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTokensHandler(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessions = newMemorySessions()
+	if userTokens, err = loadUserTokens(filepath.Join(dir, "user_tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	auth := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Mat"})
+	req := httptest.NewRequest("GET", "/tokens", nil)
+	req.AddCookie(auth)
+	csrf := csrfToken(httptest.NewRecorder(), req)
+
+	w := postForm(csrfProtect(createTokenHandler), "/tokens/create", url.Values{
+		csrfField: {csrf},
+		"label":   {"bot"},
+		"scope":   {"read", "write"},
+		"days":    {"30"},
+	}, auth)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a token got status %d: %s", w.Code, w.Body)
+	}
+	token := regexp.MustCompile(userTokenPrefix + `[0-9a-f]+`).FindString(w.Body.String())
+	made, ok := userTokens.Lookup(token)
+	if !ok || made.Label != "bot" || len(made.Scopes) != 2 || made.Expires.IsZero() {
+		t.Fatalf("the page should show the new token, got %q as %+v", token, made)
+	}
+
+	// tokens cannot be used to manage tokens
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	tokensHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("the page should need the browser session, got %d", w.Code)
+	}
+
+	w = postForm(csrfProtect(revokeTokenHandler), "/tokens/revoke", url.Values{
+		csrfField: {csrf},
+		"id":      {made.ID},
+	}, auth)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("revoking a token got status %d: %s", w.Code, w.Body)
+	}
+	if list := userTokens.List("abc"); len(list) != 0 {
+		t.Errorf("the token should be gone, got %+v", list)
+	}
+}
+
+func TestTokenSubprotocol(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	if userTokens, err = loadUserTokens(filepath.Join(dir, "user_tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := userTokens.Create(map[string]interface{}{"userid": "abc", "name": "Mat"}, "bot", []scope{scopeRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(rooms)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/room"
+
+	// the token alone leaves the server nothing to answer with
+	dialer := websocket.Dialer{Subprotocols: []string{tokenSubprotocolPrefix + token}}
+	_, resp, err := dialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("a token without a format should be refused, got %v", err)
+	}
+
+	dialer.Subprotocols = []string{subprotocolMsgpack, tokenSubprotocolPrefix + token}
+	socket, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	if socket.Subprotocol() != subprotocolMsgpack {
+		t.Errorf("the format should be agreed on, got %q", socket.Subprotocol())
+	}
+}
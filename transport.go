@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	Fallback transports untuk browser yang tidak bisa memakai web socket,
+	misalnya karena proxy yang memutus koneksi web socket.
+
+	Server-Sent Events (SSE) dan long-polling sama-sama membuat client biasa
+	yang join ke room, hanya saja pesan dari client.send dikirim lewat HTTP
+	response, bukan lewat socket. Pesan dari browser dikirim lewat POST ke
+	/room/send.
+*/
+
+const (
+	// longPollWait is how long a poll waits for a message before
+	// returning empty handed.
+	longPollWait = 25 * time.Second
+	// longPollExpiry is how long a long-poll client stays in the room
+	// without polling.
+	longPollExpiry = time.Minute
+	// sseKeepAlive is how often an idle event stream sends a comment
+	// so proxies do not close it.
+	sseKeepAlive = 20 * time.Second
+)
+
+// httpClient is a client attached to a room over plain HTTP.
+type httpClient struct {
+	*client
+	id string
+	// poll serializes the polls of a long-poll client.
+	poll sync.Mutex
+	// lastSeen is guarded by the mutex of httpClients.
+	lastSeen time.Time
+	longPoll bool
+}
+
+// httpClients keeps the HTTP clients by id, so messages posted to
+// /room/send go out as the right client.
+type httpClients struct {
+	mu      sync.Mutex
+	clients map[string]*httpClient
+}
+
+var transports = &httpClients{clients: make(map[string]*httpClient)}
+
+// attach joins a new HTTP client to the room named in the request.
+func (h *httpClients) attach(w http.ResponseWriter, req *http.Request, longPoll bool) (*httpClient, bool) {
+	name := req.URL.Query().Get("room")
+	if name == "" {
+		name = mainRoom
+	}
+	r, err := rooms.get(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	userData, ok := r.authorize(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	c := &httpClient{
+		client: &client{
+			send:     make(chan *message, messageBufferSize),
+			room:     r,
+			userData: userData,
+		},
+		id:       hex.EncodeToString(id),
+		lastSeen: time.Now(),
+		longPoll: longPoll,
+	}
+	if _, err := r.enter(c.client); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	h.mu.Lock()
+	h.clients[c.id] = c
+	h.mu.Unlock()
+	return c, true
+}
+
+// detach forgets the client and takes it out of its room. Leaving
+// the room happens on a goroutine of its own, so expire never waits
+// on a busy room.
+func (h *httpClients) detach(c *httpClient) {
+	h.mu.Lock()
+	delete(h.clients, c.id)
+	h.mu.Unlock()
+	go c.room.exit(c.client)
+}
+
+// find gets the HTTP client with the id, if it belongs to the user
+// making the request.
+func (h *httpClients) find(req *http.Request) (*httpClient, bool) {
+	userData, err := requestUserData(req)
+	if err != nil {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.clients[req.URL.Query().Get("session")]
+	if !ok || c.userID() != userData["userid"] {
+		return nil, false
+	}
+	c.lastSeen = time.Now()
+	return c, true
+}
+
+// touch marks the client as still being around.
+func (h *httpClients) touch(c *httpClient) {
+	h.mu.Lock()
+	c.lastSeen = time.Now()
+	h.mu.Unlock()
+}
+
+// expire detaches long-poll clients that stopped polling, until the
+// program ends.
+func (h *httpClients) expire() {
+	for range time.Tick(longPollExpiry / 4) {
+		var expired []*httpClient
+		h.mu.Lock()
+		for _, c := range h.clients {
+			if c.longPoll && time.Since(c.lastSeen) > longPollExpiry {
+				expired = append(expired, c)
+			}
+		}
+		h.mu.Unlock()
+		for _, c := range expired {
+			h.detach(c)
+		}
+	}
+}
+
+// eventsHandler streams the room's messages as Server-Sent Events,
+// each event being the same JSON client.write sends over the socket.
+// The first event, named session, carries the id to post messages with.
+// format: GET /room/events?room={room}
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	c, ok := transports.attach(w, req, false)
+	if !ok {
+		return
+	}
+	defer transports.detach(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// ask nginx style proxies not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", c.id)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				// kicked, or turned away from a full room
+				fmt.Fprintf(w, "event: close\ndata: %s\n\n", c.closeReason)
+				flusher.Flush()
+				return
+			}
+			data, err := msg.frame(formatJSON)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// pollResponse is the reply to a long poll.
+type pollResponse struct {
+	Session  string
+	Messages []*message
+	// Closed is set, along with the reason, once the client was
+	// removed from the room.
+	Closed bool   `json:",omitempty"`
+	Reason string `json:",omitempty"`
+}
+
+// pollHandler is the long-poll transport. The first request, without
+// a session, joins the room and returns the session id. Every later
+// request waits until there are messages and returns all of them.
+// format: GET /room/poll?room={room}&session={session}
+func pollHandler(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("session") == "" {
+		if c, ok := transports.attach(w, req, true); ok {
+			writeJSON(w, pollResponse{Session: c.id, Messages: []*message{}})
+		}
+		return
+	}
+
+	c, ok := transports.find(req)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	c.poll.Lock()
+	defer c.poll.Unlock()
+	defer transports.touch(c)
+
+	resp := pollResponse{Session: c.id, Messages: []*message{}}
+	timeout := time.NewTimer(longPollWait)
+	defer timeout.Stop()
+	select {
+	case msg, ok := <-c.send:
+		if !ok {
+			resp.Closed, resp.Reason = true, c.closeReason
+			transports.detach(c)
+			break
+		}
+		resp.Messages = append(resp.Messages, msg)
+		// take whatever else is already waiting
+		for more := true; more && len(resp.Messages) < messageBufferSize; {
+			select {
+			case msg, ok := <-c.send:
+				if !ok {
+					more = false
+					break
+				}
+				resp.Messages = append(resp.Messages, msg)
+			default:
+				more = false
+			}
+		}
+	case <-timeout.C:
+	case <-req.Context().Done():
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// sendHandler takes a message from an SSE or long-poll client, in the
+// same JSON the web socket reads.
+// format: POST /room/send?session={session}
+func sendHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, ok := transports.find(req)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	var msg *message
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil || msg == nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+	if !c.submit(msg) {
+		http.Error(w, "The room has closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestRooms points the rooms, bans and roles the handlers use at
+// stores in dir, with a public main room.
+func useTestRooms(t *testing.T, dir string) {
+	store, err := loadRoomStore(filepath.Join(dir, "rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(roomConfig{Name: mainRoom, Visibility: visibilityPublic})
+	if bans, err = loadBanList(filepath.Join(dir, "bans.json")); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err = loadRoleStore(filepath.Join(dir, "roles.json"), roleMember); err != nil {
+		t.Fatal(err)
+	}
+	if directory, err = loadUserDirectory(filepath.Join(dir, "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	rooms = newRoomRegistry(store)
+	rooms.bans = bans
+	rooms.roles = roles
+}
+
+func TestLongPoll(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+
+	cookie := testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"})
+	do := func(method, url, body string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	poll := func(url string) pollResponse {
+		w := do("GET", url, "", pollHandler)
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll got status %d: %s", w.Code, w.Body)
+		}
+		var resp pollResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := poll("/room/poll?room=main")
+	if first.Session == "" {
+		t.Fatal("the first poll should start a session")
+	}
+
+	w := do("POST", "/room/send?session="+first.Session, `{"Message":"hello","System":true,"Settings":{"Topic":"spoofed"}}`, sendHandler)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("send got status %d: %s", w.Code, w.Body)
+	}
+
+	resp := poll("/room/poll?room=main&session=" + first.Session)
+	if len(resp.Messages) != 1 || resp.Messages[0].Message != "hello" || resp.Messages[0].UserID != "abc" || resp.Messages[0].System || resp.Messages[0].Settings != nil {
+		t.Errorf("poll should return the message that was sent, got %+v", resp.Messages)
+	}
+
+	// another user cannot post through the session
+	cookie = testAuthCookie(t, map[string]interface{}{"userid": "xyz"})
+	if w := do("POST", "/room/send?session="+first.Session, `{"Message":"hi"}`, sendHandler); w.Code != http.StatusNotFound {
+		t.Errorf("sending as someone else should fail, got status %d", w.Code)
+	}
+}
+
+// TestRoomWithoutUpgrade is a web socket request that lost its Upgrade
+// header on the way, as behind some proxies. The request fails and the
+// client falls back to another transport, the server carries on.
+func TestRoomWithoutUpgrade(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+
+	req := httptest.NewRequest("GET", "/room?room=main", nil)
+	req.AddCookie(testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"}))
+	w := httptest.NewRecorder()
+	rooms.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a plain GET should be refused, got status %d", w.Code)
+	}
+}
+
+// TestLongPollStalled keeps posting to a room with a long-poll client
+// that stopped polling, then expires the client.
+func TestLongPollStalled(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+
+	req := httptest.NewRequest("GET", "/room/poll?room="+mainRoom, nil)
+	req.AddCookie(testAuthCookie(t, map[string]interface{}{"userid": "abc", "name": "Abc"}))
+	w := httptest.NewRecorder()
+	pollHandler(w, req)
+	var resp pollResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	transports.mu.Lock()
+	c := transports.clients[resp.Session]
+	transports.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < messageBufferSize+fanoutQueueSize+10; i++ {
+			c.submit(&message{Message: "hello"})
+		}
+		transports.detach(c)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a client that stopped polling should not hold up the room")
+	}
+	timeout := time.After(time.Second)
+	for {
+		if info, _ := rooms.info(mainRoom); info.Occupancy == 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("the expired client should leave the room")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
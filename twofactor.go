@@ -0,0 +1,702 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Two-factor sign in (TOTP, RFC 6238) untuk akun lokal. User memindai
+	QR code dari URI otpauth:// dengan aplikasi authenticator, lalu
+	memasukkan kode 6 digit untuk mengaktifkannya, dan mendapat recovery
+	code untuk dipakai bila HP-nya hilang.
+
+	Setelah itu password saja tidak memberi cookie auth. Login yang menunggu
+	kode disimpan di session store selama beberapa menit, browser hanya
+	mendapat cookie "2fa" yang ditandatangani berisi ID-nya. Session baru
+	dimulai setelah kode (atau salah satu recovery code) benar, dan login
+	yang menunggu itu langsung dihapus, jadi cookie-nya hanya bisa dipakai
+	sekali.
+
+	Operator bisa mewajibkan 2FA untuk role tertentu (two_factor_roles di
+	auth config). User dengan role itu, di server atau di room mana saja,
+	yang belum memasang 2FA harus memasangnya dulu saat login. Ini dicek
+	di setiap login: login lewat provider dari user yang punya akun lokal
+	dengan 2FA juga harus memasukkan kode, dan user yang wajib 2FA tanpa
+	akun lokal tidak bisa login lewat provider.
+*/
+
+const (
+	// totpPeriod is how many seconds a code lasts.
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods a code may be early or late, for
+	// phones whose clock drifts.
+	totpSkew = 1
+	// recoveryCodeCount is how many recovery codes are handed out.
+	recoveryCodeCount = 10
+	// twoFactorLoginTTL is how long after the password the code may
+	// be entered.
+	twoFactorLoginTTL = 5 * time.Minute
+	// twoFactorLoginPrefix starts the IDs of the logins waiting for
+	// their second factor in the session store. They have no user ID,
+	// so they are never a signed in session themselves.
+	twoFactorLoginPrefix = "2fa-"
+	// maxCodeFailures wrong codes in a row lock the second step of the
+	// account for codeLockout.
+	maxCodeFailures = 5
+	codeLockout     = 5 * time.Minute
+)
+
+var (
+	// ErrWrongCode is returned for a code that does not match.
+	ErrWrongCode = errors.New("chat: Wrong code.")
+	// ErrCodeLocked is returned after too many wrong codes.
+	ErrCodeLocked = errors.New("chat: Too many wrong codes, try again in a few minutes.")
+	// ErrNoTwoFactorSetup is returned when enabling before a key was
+	// made.
+	ErrNoTwoFactorSetup = errors.New("chat: Start setting up two-factor sign in first.")
+	// ErrTwoFactorRequired is returned when turning off two-factor
+	// sign in a role requires.
+	ErrTwoFactorRequired = errors.New("chat: Your role requires two-factor sign in.")
+)
+
+var (
+	// twoFactorRoles must sign in with a second factor, see authConfig.
+	twoFactorRoles []role
+	// twoFactorIssuer names the server in authenticator apps.
+	twoFactorIssuer = "Chat"
+)
+
+// totpEncoding is how keys are written for authenticator apps.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp is the one time password of RFC 4226 for the counter.
+func hotp(key []byte, counter uint64, digits int, h func() hash.Hash) string {
+	mac := hmac.New(h, key)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// totpStep is the RFC 6238 time step at t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode is the code an authenticator app shows at t.
+func totpCode(key []byte, t time.Time) string {
+	return hotp(key, uint64(totpStep(t)), totpDigits, sha1.New)
+}
+
+// matchTOTP finds the time step near now the code is for. Steps up to
+// last were used already and are not accepted again.
+func matchTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(s), totpDigits, sha1.New)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// newTOTPSecret makes a key for an authenticator app.
+func newTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// provisioningURI is the otpauth URI authenticator apps read from the
+// QR code.
+func provisioningURI(secret, username string) string {
+	v := url.Values{
+		"secret":    {secret},
+		"issuer":    {twoFactorIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(twoFactorIssuer+":"+username) + "?" + v.Encode()
+}
+
+// hashRecoveryCode is how recovery codes are kept. Dashes, spaces and
+// case do not matter when typing one in.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes makes the recovery codes to show the user and the
+// hashes to keep.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// codeFailures counts the wrong codes entered for an account.
+type codeFailures struct {
+	count int
+	last  time.Time
+}
+
+// TwoFactor reports whether the account signs in with a second
+// factor, and how many recovery codes it has left.
+func (s *accountStore) TwoFactor(username string) (bool, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	if !ok || a.TOTPSecret == "" {
+		return false, 0
+	}
+	return true, len(a.RecoveryCodes)
+}
+
+// BeginTwoFactor makes a new key for the account, which is only used
+// once a code from it is entered.
+func (s *accountStore) BeginTwoFactor(username string) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	if !ok {
+		return "", ErrWrongPassword
+	}
+	old := a.TOTPPending
+	a.TOTPPending = secret
+	if err := saveJSON(s.path, s.accounts); err != nil {
+		a.TOTPPending = old
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTwoFactor turns two-factor sign in on with the key made by
+// BeginTwoFactor, once the code matches it. The new recovery codes
+// are returned, they are only kept as hashes.
+func (s *accountStore) EnableTwoFactor(username, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	if !ok || a.TOTPPending == "" {
+		return nil, ErrNoTwoFactorSetup
+	}
+	if err := s.checkLockout(a.Username); err != nil {
+		return nil, err
+	}
+	step, ok := matchTOTP(a.TOTPPending, strings.TrimSpace(code), time.Now(), 0)
+	if !ok {
+		s.fail(a.Username)
+		return nil, ErrWrongCode
+	}
+
+	old := *a
+	a.TOTPSecret, a.TOTPPending, a.TOTPLastStep, a.RecoveryCodes = a.TOTPPending, "", step, hashes
+	if err := saveJSON(s.path, s.accounts); err != nil {
+		*a = old
+		return nil, err
+	}
+	delete(s.failures, a.Username)
+	return codes, nil
+}
+
+// DisableTwoFactor turns two-factor sign in off, once a code or a
+// recovery code is given.
+func (s *accountStore) DisableTwoFactor(username, code string) error {
+	if err := s.VerifyCode(username, code); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[strings.ToLower(username)]
+	old := *a
+	a.TOTPSecret, a.TOTPPending, a.TOTPLastStep, a.RecoveryCodes = "", "", 0, nil
+	if err := saveJSON(s.path, s.accounts); err != nil {
+		*a = old
+		return err
+	}
+	return nil
+}
+
+// VerifyCode checks a code from the authenticator app, or uses up a
+// recovery code. Codes are refused for a while after too many wrong
+// ones.
+func (s *accountStore) VerifyCode(username, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[strings.ToLower(username)]
+	if !ok || a.TOTPSecret == "" {
+		return ErrWrongCode
+	}
+	if err := s.checkLockout(a.Username); err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTP(a.TOTPSecret, code, time.Now(), a.TOTPLastStep); ok {
+		old := a.TOTPLastStep
+		a.TOTPLastStep = step
+		if err := saveJSON(s.path, s.accounts); err != nil {
+			a.TOTPLastStep = old
+			return err
+		}
+		delete(s.failures, a.Username)
+		return nil
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, h := range a.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hashed)) != 1 {
+			continue
+		}
+		old := a.RecoveryCodes
+		a.RecoveryCodes = append(append([]string{}, old[:i]...), old[i+1:]...)
+		if err := saveJSON(s.path, s.accounts); err != nil {
+			a.RecoveryCodes = old
+			return err
+		}
+		delete(s.failures, a.Username)
+		return nil
+	}
+
+	s.fail(a.Username)
+	return ErrWrongCode
+}
+
+// checkLockout refuses codes for an account with too many wrong ones.
+// It must be called with the lock held.
+func (s *accountStore) checkLockout(username string) error {
+	f, ok := s.failures[username]
+	if !ok || f.count < maxCodeFailures {
+		return nil
+	}
+	if time.Since(f.last) < codeLockout {
+		return ErrCodeLocked
+	}
+	delete(s.failures, username)
+	return nil
+}
+
+// fail counts a wrong code. It must be called with the lock held.
+func (s *accountStore) fail(username string) {
+	if s.failures == nil {
+		s.failures = make(map[string]*codeFailures)
+	}
+	f, ok := s.failures[username]
+	if !ok {
+		f = &codeFailures{}
+		s.failures[username] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+// twoFactorRequired reports whether the user holds a role that must
+// sign in with a second factor.
+func twoFactorRequired(userID string) bool {
+	if roles == nil {
+		return false
+	}
+	for _, held := range roles.Held(userID) {
+		for _, r := range twoFactorRoles {
+			if held == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signInLocal signs in a local account whose password was checked,
+// asking for the second factor first if the account has one or its
+// role requires one.
+func signInLocal(w http.ResponseWriter, req *http.Request, a *account) {
+	enabled, _ := accounts.TwoFactor(a.Username)
+	if !enabled {
+		u, err := directory.Resolve(localUser{a}, "")
+		if err != nil || !twoFactorRequired(u.ID) {
+			completeLogin(w, req, localUser{a}, "")
+			return
+		}
+	}
+	if err := setTwoFactorLogin(w, a.Username, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/twofactor")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// setTwoFactorLogin remembers that the password of the account was
+// given, in the session store with the ID in a signed cookie. Verified
+// is set once a new authenticator was set up, which proves the second
+// factor already.
+func setTwoFactorLogin(w http.ResponseWriter, username string, verified bool) error {
+	nonce, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	login := &session{
+		ID:      twoFactorLoginPrefix + nonce,
+		Data:    map[string]interface{}{"user": username, "verified": verified},
+		Created: now,
+		Expires: now.Add(twoFactorLoginTTL),
+	}
+	if err := sessions.Create(login); err != nil {
+		return err
+	}
+	value, err := authCookies.Encode(map[string]interface{}{"login": login.ID})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "2fa",
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(twoFactorLoginTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// twoFactorLoginID gets the ID of the login the 2fa cookie is for.
+func twoFactorLoginID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie("2fa")
+	if err != nil {
+		return "", false
+	}
+	data, err := authCookies.Decode(cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	id, _ := data["login"].(string)
+	return id, strings.HasPrefix(id, twoFactorLoginPrefix)
+}
+
+// twoFactorLogin gets the account waiting for its second factor in
+// this browser.
+func twoFactorLogin(r *http.Request) (username string, verified, ok bool) {
+	id, ok := twoFactorLoginID(r)
+	if !ok {
+		return "", false, false
+	}
+	return loginAccount(sessions.Get(id))
+}
+
+// takeTwoFactorLogin is twoFactorLogin, also ending the waiting login
+// so it cannot be used again.
+func takeTwoFactorLogin(r *http.Request) (username string, verified, ok bool) {
+	id, ok := twoFactorLoginID(r)
+	if !ok {
+		return "", false, false
+	}
+	return loginAccount(sessions.Take(id))
+}
+
+func loginAccount(login *session, err error) (username string, verified, ok bool) {
+	if err != nil {
+		return "", false, false
+	}
+	username, _ = login.Data["user"].(string)
+	verified, _ = login.Data["verified"].(bool)
+	return username, verified, username != ""
+}
+
+func clearTwoFactorLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "2fa", Path: "/", MaxAge: -1})
+}
+
+// checkSecondFactor sends a login through a provider to the two-factor
+// pages when the user has a local account with two-factor sign in, or
+// a role requiring it, in which case it returns false. The login then
+// finishes as the local account, which is the same user.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, u *directoryUser) bool {
+	username, local := localUsername(u.ID)
+	enabled := false
+	if local && accounts != nil {
+		enabled, _ = accounts.TwoFactor(username)
+	}
+	if !enabled && !twoFactorRequired(u.ID) {
+		return true
+	}
+	if !local {
+		renderError(w, http.StatusForbidden, "Two-factor sign in required",
+			"Your role requires a second factor, which needs an account with a password. Please ask an admin.")
+		return false
+	}
+	if err := setTwoFactorLogin(w, username, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Location", "/twofactor")
+	w.WriteHeader(http.StatusSeeOther)
+	return false
+}
+
+// twoFactorAccount gets the local account the two-factor pages are
+// for: the one waiting to sign in, or else the signed in one.
+func twoFactorAccount(r *http.Request) (username string, pending bool, ok bool) {
+	if username, _, ok := twoFactorLogin(r); ok {
+		return username, true, true
+	}
+	userData, err := authUserData(r)
+	if err != nil {
+		return "", false, false
+	}
+	userID, _ := userData["userid"].(string)
+	username, ok = localUsername(userID)
+	return username, false, ok
+}
+
+// twoFactorPage is template/twofactor.html.
+var twoFactorPage = &page{filename: "twofactor.html"}
+
+// renderTwoFactor shows a step of the two-factor pages: "verify",
+// "settings", "setup" or "codes".
+func renderTwoFactor(w http.ResponseWriter, req *http.Request, status int, step string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Step"] = step
+	data["CSRF"] = csrfToken(w, req)
+	if err := twoFactorPage.render(w, status, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// twoFactorHandler asks for the code of a login waiting for it, or
+// shows the settings of the signed in account.
+// format: GET /twofactor
+func twoFactorHandler(w http.ResponseWriter, req *http.Request) {
+	username, pending, ok := twoFactorAccount(req)
+	if !ok {
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+	enabled, left := accounts.TwoFactor(username)
+	if pending && enabled {
+		renderTwoFactor(w, req, http.StatusOK, "verify", nil)
+		return
+	}
+	a, _ := accounts.Account(username)
+	u, err := directory.Resolve(localUser{a}, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTwoFactor(w, req, http.StatusOK, "settings", map[string]interface{}{
+		"Pending":  pending,
+		"Enabled":  enabled,
+		"Required": twoFactorRequired(u.ID),
+		"Left":     left,
+	})
+}
+
+// twoFactorSetupHandler makes a new key and shows it as a QR code.
+// format: POST /accounts/2fa/setup
+func twoFactorSetupHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, pending, ok := twoFactorAccount(req)
+	if !ok {
+		http.Error(w, "You must be signed in with a password", http.StatusUnauthorized)
+		return
+	}
+	if enabled, _ := accounts.TwoFactor(username); enabled && pending {
+		// the password alone must not replace the authenticator
+		http.Error(w, "Enter the code from your authenticator app", http.StatusForbidden)
+		return
+	}
+	secret, err := accounts.BeginTwoFactor(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTwoFactor(w, req, http.StatusOK, "setup", map[string]interface{}{
+		"Secret": secret,
+		"URI":    provisioningURI(secret, username),
+	})
+}
+
+// twoFactorEnableHandler turns two-factor sign in on once a code from
+// the new key is entered, showing the recovery codes.
+// format: POST /accounts/2fa/enable code={code}
+func twoFactorEnableHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, pending, ok := twoFactorAccount(req)
+	if !ok {
+		http.Error(w, "You must be signed in with a password", http.StatusUnauthorized)
+		return
+	}
+	if enabled, _ := accounts.TwoFactor(username); enabled && pending {
+		http.Error(w, "Enter the code from your authenticator app", http.StatusForbidden)
+		return
+	}
+	codes, err := accounts.EnableTwoFactor(username, req.FormValue("code"))
+	switch err {
+	case nil:
+	case ErrWrongCode, ErrNoTwoFactorSetup:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrCodeLocked:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		// the code just entered is the second factor of this login,
+		// which starts waiting again as verified
+		if _, _, ok := takeTwoFactorLogin(req); !ok {
+			renderError(w, http.StatusUnauthorized, "Sign in failed", "The sign in took too long, please enter your password again.")
+			return
+		}
+		if err := setTwoFactorLogin(w, username, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderTwoFactor(w, req, http.StatusOK, "codes", map[string]interface{}{
+		"Pending": pending,
+		"Codes":   codes,
+	})
+}
+
+// twoFactorVerifyHandler signs in the login waiting for its second
+// factor once the code or a recovery code is right.
+// format: POST /accounts/2fa/verify code={code}
+func twoFactorVerifyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, verified, ok := twoFactorLogin(req)
+	if !ok {
+		renderError(w, http.StatusUnauthorized, "Sign in failed", "The sign in took too long, please enter your password again.")
+		return
+	}
+	if !verified {
+		err := accounts.VerifyCode(username, req.FormValue("code"))
+		if err == ErrWrongCode || err == ErrCodeLocked {
+			log.Println("Two-factor sign in failed for", username, "-", err)
+			renderTwoFactor(w, req, http.StatusUnauthorized, "verify", map[string]interface{}{
+				"Error": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// the waiting login is used up here, whoever gets it first signs
+	// in and the cookie is worth nothing after
+	if _, _, ok := takeTwoFactorLogin(req); !ok {
+		renderError(w, http.StatusUnauthorized, "Sign in failed", "The sign in took too long, please enter your password again.")
+		return
+	}
+	clearTwoFactorLogin(w)
+	a, ok := accounts.Account(username)
+	if !ok {
+		http.Error(w, ErrWrongPassword.Error(), http.StatusUnauthorized)
+		return
+	}
+	completeLogin(w, req, localUser{a}, "")
+}
+
+// twoFactorDisableHandler turns two-factor sign in off for the signed
+// in account, unless its role requires it.
+// format: POST /accounts/2fa/disable code={code}
+func twoFactorDisableHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	username, ok := localUsername(userID)
+	if !ok {
+		http.Error(w, "You have no password to protect", http.StatusBadRequest)
+		return
+	}
+	if twoFactorRequired(userID) {
+		http.Error(w, ErrTwoFactorRequired.Error(), http.StatusForbidden)
+		return
+	}
+	err := accounts.DisableTwoFactor(username, req.FormValue("code"))
+	switch err {
+	case nil:
+	case ErrWrongCode:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrCodeLocked:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/twofactor")
+	w.WriteHeader(http.StatusSeeOther)
+}
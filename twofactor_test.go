@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTOTPVectors checks the codes against the test vectors of
+// RFC 6238, appendix B.
+func TestTOTPVectors(t *testing.T) {
+
+	keys := []struct {
+		h   func() hash.Hash
+		key string
+	}{
+		{sha1.New, "12345678901234567890"},
+		{sha256.New, "12345678901234567890123456789012"},
+		{sha512.New, "1234567890123456789012345678901234567890123456789012345678901234"},
+	}
+	vectors := []struct {
+		unix  int64
+		codes [3]string
+	}{
+		{59, [3]string{"94287082", "46119246", "90693936"}},
+		{1111111109, [3]string{"07081804", "68084774", "25091201"}},
+		{1111111111, [3]string{"14050471", "67062674", "99943326"}},
+		{1234567890, [3]string{"89005924", "91819424", "93441116"}},
+		{2000000000, [3]string{"69279037", "90698825", "38618901"}},
+		{20000000000, [3]string{"65353130", "77737706", "47863826"}},
+	}
+	for _, v := range vectors {
+		step := uint64(totpStep(time.Unix(v.unix, 0)))
+		for i, k := range keys {
+			if got := hotp([]byte(k.key), step, 8, k.h); got != v.codes[i] {
+				t.Errorf("at %d key %d gave %s, want %s", v.unix, i, got, v.codes[i])
+			}
+		}
+	}
+
+	// the six digit codes apps show are the last digits
+	secret := totpEncoding.EncodeToString([]byte(keys[0].key))
+	if step, ok := matchTOTP(secret, "287082", time.Unix(59, 0), 0); !ok || step != 1 {
+		t.Errorf("matchTOTP wrongly gave %d, %v", step, ok)
+	}
+	if _, ok := matchTOTP(secret, "287082", time.Unix(59, 0), 1); ok {
+		t.Error("a code should not be accepted twice")
+	}
+	if _, ok := matchTOTP(secret, "287082", time.Unix(59+2*totpPeriod, 0), 0); ok {
+		t.Error("a code should not be accepted long after it was shown")
+	}
+
+	uri, err := url.Parse(provisioningURI(secret, "mat"))
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Query().Get("secret") != secret {
+		t.Errorf("provisioningURI wrongly gave %v, %v", uri, err)
+	}
+}
+
+func TestTwoFactorStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "twofactor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestAccounts(t, dir)
+	if _, err := accounts.Register("mat", "", "", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := accounts.EnableTwoFactor("mat", "123456"); err != ErrNoTwoFactorSetup {
+		t.Errorf("enabling before setting up should fail, got %v", err)
+	}
+	secret, err := accounts.BeginTwoFactor("mat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := accounts.TwoFactor("mat"); enabled {
+		t.Error("two-factor sign in should only be on once a code was entered")
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now()
+	codes, err := accounts.EnableTwoFactor("mat", totpCode(key, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, left := accounts.TwoFactor("mat"); !enabled || left != recoveryCodeCount || len(codes) != recoveryCodeCount {
+		t.Errorf("enabling wrongly gave %v with %d codes left", codes, left)
+	}
+
+	if err := accounts.VerifyCode("mat", totpCode(key, now)); err != ErrWrongCode {
+		t.Errorf("the code used to enable should not be accepted again, got %v", err)
+	}
+	if err := accounts.VerifyCode("mat", totpCode(key, now.Add(totpPeriod*time.Second))); err != nil {
+		t.Errorf("the next code should be accepted, got %v", err)
+	}
+	if err := accounts.VerifyCode("mat", strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("a recovery code should be accepted, got %v", err)
+	}
+	if err := accounts.VerifyCode("mat", codes[0]); err != ErrWrongCode {
+		t.Errorf("a recovery code should only be used once, got %v", err)
+	}
+	if _, left := accounts.TwoFactor("mat"); left != recoveryCodeCount-1 {
+		t.Errorf("one recovery code should be used up, %d left", left)
+	}
+
+	reloaded, err := loadAccounts(accounts.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := reloaded.TwoFactor("mat"); !enabled {
+		t.Error("two-factor sign in should be kept in the file")
+	}
+
+	for i := 0; i < maxCodeFailures; i++ {
+		accounts.VerifyCode("mat", "000000")
+	}
+	if err := accounts.VerifyCode("mat", codes[1]); err != ErrCodeLocked {
+		t.Errorf("too many wrong codes should lock the account for a while, got %v", err)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "twofactor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	useTestRooms(t, dir)
+	useTestAccounts(t, dir)
+	sessions = newMemorySessions()
+	defer func() { twoFactorRoles = nil }()
+
+	login := func(username string) *httptest.ResponseRecorder {
+		return postForm(localLoginHandler, "/accounts/login", url.Values{"username": {username}, "password": {"correct horse"}})
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name && c.MaxAge >= 0 {
+				return c
+			}
+		}
+		return nil
+	}
+	// csrf gets a token for a browser without a session, with the
+	// cookie it goes with
+	csrf := func() (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		token := csrfToken(w, httptest.NewRequest("GET", "/twofactor", nil))
+		return token, cookie(w, "csrf")
+	}
+
+	// an account with an authenticator
+	if _, err := accounts.Register("mat", "", "", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := accounts.BeginTwoFactor("mat")
+	key, _ := totpEncoding.DecodeString(secret)
+	if _, err := accounts.EnableTwoFactor("mat", totpCode(key, time.Now().Add(-totpPeriod*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	w := login("mat")
+	pending := cookie(w, "2fa")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/twofactor" || pending == nil || cookie(w, "auth") != nil {
+		t.Fatalf("the password alone should ask for the code, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	token, csrfCookie := csrf()
+	w = postForm(csrfProtect(twoFactorSetupHandler), "/accounts/2fa/setup", url.Values{csrfField: {token}}, pending, csrfCookie)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("the password alone should not replace the authenticator, got %d", w.Code)
+	}
+	w = postForm(csrfProtect(twoFactorVerifyHandler), "/accounts/2fa/verify", url.Values{csrfField: {token}, "code": {"000000"}}, pending, csrfCookie)
+	if w.Code != http.StatusUnauthorized || cookie(w, "auth") != nil {
+		t.Errorf("a wrong code should be refused, got %d", w.Code)
+	}
+	w = postForm(csrfProtect(twoFactorVerifyHandler), "/accounts/2fa/verify", url.Values{csrfField: {token}, "code": {totpCode(key, time.Now())}}, pending, csrfCookie)
+	if w.Code != http.StatusSeeOther || cookie(w, "auth") == nil {
+		t.Fatalf("the right code should sign in, got %d: %s", w.Code, w.Body)
+	}
+
+	// a provider linked to the same user asks for the code too
+	matData, _ := authUserData(signedIn(cookie(w, "auth")))
+	github := testLogin{"github", "1", "", "Mat"}
+	if _, err := directory.Resolve(github, matData["userid"].(string)); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	completeLogin(w, httptest.NewRequest("GET", "/auth/callback/github", nil), github, "")
+	if w.Header().Get("Location") != "/twofactor" || cookie(w, "2fa") == nil || cookie(w, "auth") != nil {
+		t.Errorf("a linked provider should ask for the code, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// a role that must use two-factor sign in
+	if _, err := accounts.Register("ann", "", "", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if w = login("ann"); cookie(w, "auth") == nil {
+		t.Fatal("without two-factor sign in the password should be enough")
+	}
+	twoFactorRoles = []role{roleMember}
+	w = login("ann")
+	pending = cookie(w, "2fa")
+	if w.Header().Get("Location") != "/twofactor" || pending == nil || cookie(w, "auth") != nil {
+		t.Fatalf("the role should require setting up two-factor sign in, got %d", w.Code)
+	}
+	w = postForm(csrfProtect(twoFactorSetupHandler), "/accounts/2fa/setup", url.Values{csrfField: {token}}, pending, csrfCookie)
+	secret = regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(w.Body.String())[1]
+	key, _ = totpEncoding.DecodeString(secret)
+	w = postForm(csrfProtect(twoFactorEnableHandler), "/accounts/2fa/enable", url.Values{csrfField: {token}, "code": {totpCode(key, time.Now())}}, pending, csrfCookie)
+	verified := cookie(w, "2fa")
+	if w.Code != http.StatusOK || verified == nil || !strings.Contains(w.Body.String(), "/accounts/2fa/verify") {
+		t.Fatalf("enabling should show the recovery codes, got %d: %s", w.Code, w.Body)
+	}
+	w = postForm(csrfProtect(twoFactorVerifyHandler), "/accounts/2fa/verify", url.Values{csrfField: {token}}, verified, csrfCookie)
+	if w.Code != http.StatusSeeOther || cookie(w, "auth") == nil {
+		t.Fatalf("setting up the authenticator should finish the sign in, got %d: %s", w.Code, w.Body)
+	}
+	replay := postForm(csrfProtect(twoFactorVerifyHandler), "/accounts/2fa/verify", url.Values{csrfField: {token}}, verified, csrfCookie)
+	if replay.Code != http.StatusUnauthorized || cookie(replay, "auth") != nil {
+		t.Errorf("a 2fa cookie should only sign in once, got %d", replay.Code)
+	}
+
+	w = postForm(csrfProtect(twoFactorDisableHandler), "/accounts/2fa/disable", url.Values{
+		csrfField: {sessionCSRFToken(sessionOf(t, cookie(w, "auth")))},
+		"code":    {totpCode(key, time.Now().Add(totpPeriod*time.Second))},
+	}, cookie(w, "auth"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("two-factor sign in the role requires should not be turned off, got %d", w.Code)
+	}
+}
+
+// signedIn is a request with the auth cookie.
+func signedIn(auth *http.Cookie) *http.Request {
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.AddCookie(auth)
+	return req
+}
+
+// sessionOf gets the session ID of an auth cookie.
+func sessionOf(t *testing.T, auth *http.Cookie) string {
+	userData, err := authUserData(signedIn(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := userData["session"].(string)
+	return id
+}
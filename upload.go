@@ -1,33 +1,44 @@
-package main
-
-import (
-	"io"
-	"ioutils"
-	"net/http"
-	"path"
-)
-
-func uploaderHandler(w http.ResponseWriter, req *http.Request) {
-
-	userId := req.FormValue("userid")
-	file, header, err := req.FormFile("avatarFile")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	filename := path.Join("avatars", userId+path.Ext(header.Filename))
-	err = ioutil.WriteFile(filename, data, 0777)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	io.WriteString(w, "Successful")
-}
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+func uploaderHandler(w http.ResponseWriter, req *http.Request) {
+
+	userData, err := authUserData(req)
+	if err != nil {
+		http.Error(w, "You must be signed in to upload a picture", http.StatusUnauthorized)
+		return
+	}
+	// the signed cookie says who is uploading, not the form
+	userId, _ := userData["userid"].(string)
+	if !roles.Role("", userId).can(permUploadAvatar) {
+		http.Error(w, "You are not allowed to upload a picture", http.StatusForbidden)
+		return
+	}
+
+	file, header, err := req.FormFile("avatarFile")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := path.Join("avatars", userId+path.Ext(header.Filename))
+	err = ioutil.WriteFile(filename, data, 0777)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, "Successful")
+}